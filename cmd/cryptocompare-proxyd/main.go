@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/admin"
 	"github.com/kovetskiy/cryptocompare-proxyd/internal/cache"
 	"github.com/kovetskiy/cryptocompare-proxyd/internal/config"
 	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/events"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/leader"
 	"github.com/kovetskiy/cryptocompare-proxyd/internal/server"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/shard"
 	"github.com/kovetskiy/cryptocompare-proxyd/internal/updater"
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
@@ -18,6 +24,17 @@ import (
 	"github.com/docopt/docopt-go"
 )
 
+// updaterLease is a name of the lease held by the instance running the
+// updater.
+const updaterLease = "updater"
+
+// coordinator coordinates the updater with the other instances sharing the
+// cache storage.
+type coordinator interface {
+	Serve()
+	Close()
+}
+
 var (
 	version = "[manual build]"
 	usage   = "cryptocompare-proxyd " + version + `
@@ -32,6 +49,7 @@ Usage:
 Options:
   -R --read-only       Run in read only mode.
   -c --config <value>  Use the specified configuration file. [default: /etc/cryptocompare-proxyd.conf]
+  --watch-config       Reload the configuration file once it's modified.
   --debug              Print debug messages.
   -h --help            Show this screen.
   --version            Show version.
@@ -43,6 +61,8 @@ type Opts struct {
 	ValueConfig  string `docopt:"--config"`
 	FlagDebug    bool   `docopt:"--debug"`
 	FlagReadOnly bool   `docopt:"--read-only"`
+
+	FlagWatchConfig bool `docopt:"--watch-config"`
 }
 
 func main() {
@@ -69,10 +89,12 @@ func main() {
 	}
 
 	cache, err := cache.New(
+		config.CacheBackend,
 		config.DatabaseAddress,
 		config.DatabaseName,
 		config.DatabaseUsername,
 		config.DatabasePassword,
+		config.SQLitePath,
 	)
 	if err != nil {
 		log.Fatalf(err, "unable to initialize cache instance")
@@ -85,50 +107,318 @@ func main() {
 
 	defer cache.Close()
 
-	client, err := cryptocompare.New(version)
+	// every written price is published to the bus, so the changes can be
+	// pushed to the clients
+	bus := events.NewBus()
+	published := events.NewCache(cache, bus)
+	cache = published
+
+	// the prices written by other instances are published as well, the
+	// listening is stopped before the cache is closed
+	listenCtx, stopListening := context.WithCancel(context.Background())
+	listening := make(chan struct{})
+	go func() {
+		defer close(listening)
+
+		published.Listen(listenCtx)
+	}()
+
+	defer func() {
+		stopListening()
+		<-listening
+	}()
+
+	budget := cryptocompare.NewBudget(
+		config.UpstreamRateLimit,
+		config.UpstreamBurst,
+		config.UpstreamReserve,
+	)
+
+	upstream, err := cryptocompare.New(cryptocompare.Options{
+		Version: version,
+		BaseURL: config.UpstreamURL,
+		APIKey:  config.UpstreamAPIKey,
+		AppName: config.UpstreamAppName,
+		Timeout: config.UpstreamTimeout,
+		Proxy:   config.UpstreamProxy,
+		Budget:  budget,
+		Retries: config.UpstreamRetries,
+	})
 	if err != nil {
 		log.Fatalf(err, "unable to initialize cryptocompare http client")
 	}
 
+	// concurrent requests of the same symbols made by the updater and the
+	// server share a single (possibly chunked) upstream request.
+	client := cryptocompare.NewCoalesced(
+		cryptocompare.NewChunked(
+			upstream,
+			cryptocompare.MaxFsymsLength,
+			cryptocompare.MaxTsymsLength,
+			config.UpstreamConcurrency,
+		),
+	)
+
 	var refresher *updater.Updater
 	if !opts.FlagReadOnly {
 		refresher, err = updater.New(
 			client,
+			config.UpstreamConcurrency,
 			cache,
-			config.Fsyms,
-			config.Tsyms,
+			groups(config),
 			config.UpdateInterval,
+			demandLimit(config),
+			config.TrackIdleTimeout,
 		)
 		if err != nil {
 			log.Fatalf(err, "unable to initialize updater")
 		}
 
-		err = refresher.Update()
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			time.Duration(config.RequestTimeout)*time.Second,
+		)
+
+		err = refresher.Load(ctx)
+		if err != nil {
+			log.Fatalf(err, "unable to load the watchlist")
+		}
+
+		// the elected leader updates the pairs once it's promoted, the shard
+		// member once it knows its share
+		if !config.LeaderElection && !config.Sharding {
+			err = refresher.Update(ctx)
+			if err != nil {
+				// the updater keeps retrying failed pairs on its own
+				log.Errorf(err, "unable to update the symbols data")
+			}
+		}
+
+		cancel()
+	}
+
+	instanceID := config.InstanceID
+	if instanceID == "" {
+		instanceID, err = leader.NewHolder()
 		if err != nil {
-			log.Fatalf(err, "unable to update the symbols data")
+			log.Fatalf(err, "unable to generate instance id")
 		}
 	}
 
+	var (
+		coordinator coordinator
+		elector     *leader.Elector
+		membership  *shard.Membership
+	)
+
+	// the updater is paused until the instance is elected as the leader
+	if refresher != nil && config.LeaderElection {
+		refresher.Pause()
+
+		elector, err = leader.New(
+			cache,
+			updaterLease,
+			instanceID,
+			config.LeaderLeaseTTL,
+			func(leading bool) {
+				if leading {
+					refresher.Resume()
+				} else {
+					refresher.Pause()
+				}
+			},
+		)
+		if err != nil {
+			log.Fatalf(err, "unable to initialize leader elector")
+		}
+
+		coordinator = elector
+	}
+
+	// the updater refreshes nothing until the instance knows its share
+	if refresher != nil && config.Sharding {
+		membership, err = shard.New(
+			cache,
+			instanceID,
+			config.ShardMemberTTL,
+			refresher.Rebalance,
+		)
+		if err != nil {
+			log.Fatalf(err, "unable to initialize shard membership")
+		}
+
+		refresher.Shard(func(pair cryptocompare.Pair) bool {
+			return membership.Owns(pair.String())
+		})
+
+		coordinator = membership
+	}
+
+	// pairs refreshed by the updater are not revalidated by the server
+	var tracker server.Tracker
+	if refresher != nil {
+		tracker = refresher
+	}
+
 	server, err := server.New(
 		config.ListenAddress,
 		cache,
 		client,
-		config.CacheTTL,
+		config.UpstreamConcurrency,
+		tracker,
+		bus,
+		serverSettings(config, opts.FlagReadOnly),
 	)
 	if err != nil {
 		log.Fatalf(err, "unable to initialize http server instance")
 	}
 
-	serve(server, refresher)
+	server.AddStatus("budget", func() interface{} {
+		return budget.Status()
+	})
+
+	server.AddStatus("events", func() interface{} {
+		return bus.Status()
+	})
+
+	server.AddStatus("websocket", func() interface{} {
+		return server.WebsocketStatus()
+	})
+
+	if refresher != nil {
+		server.AddStatus("updater", func() interface{} {
+			return refresher.Status()
+		})
+	}
+
+	if elector != nil {
+		server.AddStatus("leader", func() interface{} {
+			return elector.Status()
+		})
+	}
+
+	if membership != nil {
+		server.AddStatus("shard", func() interface{} {
+			return membership.Status()
+		})
+	}
+
+	// the admin api is served on its own address, so it's not exposed along
+	// with the public api
+	var adminServer *admin.Admin
+	if config.AdminListenAddress != "" {
+		adminServer, err = admin.New(
+			config.AdminListenAddress,
+			config.AdminToken,
+			cache,
+			refresher,
+		)
+		if err != nil {
+			log.Fatalf(err, "unable to initialize admin http server instance")
+		}
+	}
+
+	reloader := &reloader{
+		path:     opts.ValueConfig,
+		readOnly: opts.FlagReadOnly,
+		server:   server,
+		updater:  refresher,
+		config:   config,
+	}
+
+	serve(
+		server,
+		adminServer,
+		refresher,
+		coordinator,
+		reloader,
+		opts.FlagWatchConfig,
+	)
+}
+
+// serverSettings returns the settings of the http server, the prices
+// received on demand are written to the cache unless it's the read-only
+// mode. The prices of the tiers are served with the tier TTLs in every mode.
+func serverSettings(config *config.Config, readOnly bool) server.Settings {
+	return server.Settings{
+		TTL:            config.CacheTTL,
+		HardTTL:        config.CacheHardTTL,
+		TTLs:           updater.TTLs(groups(config), config.UpdateInterval),
+		RequestTimeout: config.RequestTimeout,
+		WriteThrough:   !readOnly || config.ReadOnlyWriteThrough,
+		NegativeTTL:    config.NegativeCacheTTL,
+		StaleIfError:   config.StaleIfError,
+
+		WebsocketPingInterval:   config.WebsocketPingInterval,
+		WebsocketIdleTimeout:    config.WebsocketIdleTimeout,
+		WebsocketMaxMessageSize: config.WebsocketMaxMessageSize,
+		WebsocketQueueSize:      config.WebsocketQueueSize,
+		WebsocketMaxConnections: config.WebsocketMaxConnections,
+	}
+}
+
+// demandLimit returns a maximum number of pairs tracked due to demand, zero
+// if tracking is disabled.
+func demandLimit(config *config.Config) int {
+	if !config.TrackDemand {
+		return 0
+	}
+
+	return config.TrackMaxPairs
+}
+
+// groups returns the groups of pairs listed in the configuration, every
+// combination of fsyms and tsyms is a group on its own.
+//
+// The pairs are expected to be validated by config.Load.
+func groups(config *config.Config) []updater.Group {
+	groups := []updater.Group{
+		updater.CrossGroup("", config.Fsyms, config.Tsyms),
+	}
+
+	for _, pairGroup := range config.Pairs {
+		group := updater.Group{
+			Name:     pairGroup.Name,
+			Interval: pairGroup.UpdateInterval,
+			TTL:      pairGroup.CacheTTL,
+		}
+
+		for _, value := range pairGroup.Pairs {
+			pair, _ := cryptocompare.ParsePair(value)
+
+			group.Pairs = append(group.Pairs, pair)
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups
 }
 
 func serve(
 	server *server.Server,
+	adminServer *admin.Admin,
 	refresher *updater.Updater,
+	coordinator coordinator,
+	reloader *reloader,
+	watchConfig bool,
 ) {
-	var serveError error
+	var (
+		serveError error
+		serveOnce  sync.Once
+	)
 
 	done := make(chan struct{})
+	stop := make(chan struct{})
+
+	// fail stops the program due to the given error of one of the servers
+	fail := func(err error) {
+		serveOnce.Do(func() {
+			serveError = err
+
+			close(done)
+		})
+	}
 	workers := &sync.WaitGroup{}
 
 	workers.Add(1)
@@ -139,58 +429,97 @@ func serve(
 		if err != nil && err != http.ErrServerClosed {
 			// this is a corner case when received a SIGINT signal and have
 			// to shutdown the HTTP server.
-			serveError = karma.Format(
+			fail(karma.Format(
 				err,
 				"http server: unable to listen and serve",
-			)
-
-			close(done)
+			))
 		}
 	}()
 
-	if refresher != nil {
+	if adminServer != nil {
 		workers.Add(1)
 		go func() {
 			defer workers.Done()
 
-			err := refresher.Serve()
-			if err != nil {
-				serveError = karma.Format(
+			err := adminServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				fail(karma.Format(
 					err,
-					"updater: unable to serve",
-				)
-
-				close(done)
+					"admin http server: unable to listen and serve",
+				))
 			}
 		}()
 	}
 
+	if refresher != nil {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+
+			refresher.Serve()
+		}()
+	}
+
+	if coordinator != nil {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+
+			coordinator.Serve()
+		}()
+	}
+
+	if watchConfig {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+
+			reloader.watch(stop)
+		}()
+	}
+
 	// The server can shut down in two cases:
 	// it's either user/container-orchestrator interaction: by sending os signal
 	// or an error
 	//
 	// in both cases we want to try to gracefully shut down everything we can
+	//
+	// SIGHUP reloads the configuration instead.
 
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
-
-	select {
-	case signal := <-signals:
-		log.Infof(
-			nil,
-			"the server is shutting down due to received signal '%v'",
-			signal,
-		)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+wait:
+	for {
+		select {
+		case signal := <-signals:
+			if signal == syscall.SIGHUP {
+				reloader.reload()
+				continue
+			}
 
-	case <-done:
-		if serveError != nil {
-			log.Errorf(
-				serveError,
-				"the server is shutting down due to an error",
+			log.Infof(
+				nil,
+				"the server is shutting down due to received signal '%v'",
+				signal,
 			)
+
+			break wait
+
+		case <-done:
+			if serveError != nil {
+				log.Errorf(
+					serveError,
+					"the server is shutting down due to an error",
+				)
+			}
+
+			break wait
 		}
 	}
 
+	close(stop)
+
 	err := server.Close()
 	if err != nil {
 		log.Errorf(err, "unable to gracefully shutdown the http server")
@@ -198,6 +527,19 @@ func serve(
 		log.Infof(nil, "the server has gracefully shut down")
 	}
 
+	if adminServer != nil {
+		err := adminServer.Close()
+		if err != nil {
+			log.Errorf(err, "unable to gracefully shutdown the admin http server")
+		}
+	}
+
+	// the other instances are told first, so they take over the updates
+	// right away
+	if coordinator != nil {
+		coordinator.Close()
+	}
+
 	if refresher != nil {
 		refresher.Close()
 
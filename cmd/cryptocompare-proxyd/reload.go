@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/config"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/server"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/updater"
+	"github.com/reconquest/pkg/log"
+)
+
+const (
+	// watchInterval is a duration of time between checks of the
+	// configuration file modification time.
+	watchInterval = 5 * time.Second
+)
+
+// reloader loads the configuration file again and applies the changes to the
+// running updater and server.
+type reloader struct {
+	path     string
+	readOnly bool
+
+	server  *server.Server
+	updater *updater.Updater
+
+	mutex sync.Mutex
+
+	// config is the configuration the program is started with, its static
+	// settings keep running until restart whatever is reloaded.
+	config *config.Config
+}
+
+// reload loads the configuration and applies it, the current configuration
+// keeps running if the loaded one is invalid, so the errors are logged only.
+func (reloader *reloader) reload() {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	log.Infof(nil, "reloading the configuration from %s", reloader.path)
+
+	next, err := config.Load(reloader.path)
+	if err != nil {
+		log.Errorf(err, "unable to reload the configuration")
+		return
+	}
+
+	// both the updater and the server settings are validated before
+	// applying any of them, so they are never applied partially
+	settings := serverSettings(next, reloader.readOnly)
+
+	err = settings.Validate()
+	if err != nil {
+		log.Errorf(err, "unable to reload the configuration")
+		return
+	}
+
+	if reloader.updater != nil {
+		err := reloader.updater.Reload(
+			groups(next),
+			next.UpdateInterval,
+			demandLimit(next),
+			next.TrackIdleTimeout,
+		)
+		if err != nil {
+			log.Errorf(err, "unable to reload the configuration")
+			return
+		}
+	}
+
+	err = reloader.server.Reload(settings)
+	if err != nil {
+		// the settings are validated above, so it's not expected to happen
+		log.Errorf(err, "unable to reload the http server settings")
+		return
+	}
+
+	if reloader.config.RequiresRestart(next) {
+		log.Warningf(
+			nil,
+			"some of the changed settings take effect after restart only",
+		)
+	}
+
+	log.Infof(nil, "the configuration is reloaded")
+}
+
+// watch reloads the configuration every time the file is modified until stop
+// is closed.
+func (reloader *reloader) watch(stop <-chan struct{}) {
+	log.Infof(nil, "watching the configuration file %s", reloader.path)
+
+	modifiedAt := modificationTime(reloader.path)
+	for {
+		select {
+		case <-time.After(watchInterval):
+			//
+		case <-stop:
+			return
+		}
+
+		current := modificationTime(reloader.path)
+		if current.Equal(modifiedAt) {
+			continue
+		}
+
+		modifiedAt = current
+
+		reloader.reload()
+	}
+}
+
+// modificationTime returns the modification time of the given file or zero
+// time if the file doesn't exist.
+func modificationTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
@@ -0,0 +1,348 @@
+// Package admin implements the authenticated HTTP API which allows operators
+// to manage the running program: the tracked pairs and the cache entries.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cache"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/updater"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+)
+
+const (
+	pairsPath   = "/api/v1/admin/pairs"
+	purgePath   = "/api/v1/admin/purge"
+	refreshPath = "/api/v1/admin/refresh"
+)
+
+var (
+	errUnauthorized = errors.New("missing or invalid token")
+	errReadOnly     = errors.New("there is no updater in the read-only mode")
+	errPurgeEmpty   = errors.New("either pairs or symbols param is required")
+)
+
+// Admin listens for the admin API requests on its own address, so the API is
+// not exposed along with the public one. Every request should have the
+// Authorization header with the token: "Bearer <token>".
+type Admin struct {
+	listenAddress string
+	token         string
+	http          *http.Server
+
+	cache   cache.Cache
+	updater *updater.Updater
+}
+
+// New instance of Admin, updater is nil in the read-only mode, so only the
+// cache entries can be managed.
+func New(
+	listenAddress string,
+	token string,
+	cache cache.Cache,
+	updater *updater.Updater,
+) (*Admin, error) {
+	if token == "" {
+		return nil, errors.New("admin token should not be empty")
+	}
+
+	admin := &Admin{
+		listenAddress: listenAddress,
+		token:         token,
+		cache:         cache,
+		updater:       updater,
+	}
+
+	admin.http = &http.Server{
+		Handler: admin,
+		Addr:    listenAddress,
+	}
+
+	return admin, nil
+}
+
+// ListenAndServe listens and serves received http connections.
+func (admin *Admin) ListenAndServe() error {
+	log.Infof(
+		nil,
+		"the admin http server starting at %s",
+		admin.listenAddress,
+	)
+
+	return admin.http.ListenAndServe()
+}
+
+// Close immediately closes all active http connections.
+func (admin *Admin) Close() error {
+	return admin.http.Close()
+}
+
+// ServeHTTP is invoked by net/http package when gets a connection from
+// net/http.Server.
+func (admin *Admin) ServeHTTP(
+	response http.ResponseWriter,
+	request *http.Request,
+) {
+	log.Debugf(
+		nil,
+		"%10s\t%15s\t%4s\t%s",
+		"ADMIN",
+		request.RemoteAddr,
+		request.Method,
+		request.URL.String(),
+	)
+
+	if !admin.authorized(request) {
+		writeError(response, http.StatusUnauthorized, errUnauthorized)
+		return
+	}
+
+	switch {
+	case request.URL.Path == pairsPath && request.Method == http.MethodGet:
+		admin.handleListPairs(response, request)
+
+	case request.URL.Path == pairsPath && request.Method == http.MethodPost:
+		admin.handleAddPairs(response, request)
+
+	case request.URL.Path == pairsPath && request.Method == http.MethodDelete:
+		admin.handleRemovePairs(response, request)
+
+	case request.URL.Path == purgePath && request.Method == http.MethodPost:
+		admin.handlePurge(response, request)
+
+	case request.URL.Path == refreshPath && request.Method == http.MethodPost:
+		admin.handleRefresh(response, request)
+
+	case request.URL.Path == pairsPath ||
+		request.URL.Path == purgePath ||
+		request.URL.Path == refreshPath:
+		response.WriteHeader(http.StatusMethodNotAllowed)
+
+	default:
+		response.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (admin *Admin) authorized(request *http.Request) bool {
+	const prefix = "Bearer "
+
+	header := request.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+
+	token := strings.TrimPrefix(header, prefix)
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(admin.token)) == 1
+}
+
+func (admin *Admin) handleListPairs(
+	response http.ResponseWriter,
+	request *http.Request,
+) {
+	if admin.updater == nil {
+		writeError(response, http.StatusServiceUnavailable, errReadOnly)
+		return
+	}
+
+	writeJSON(response, http.StatusOK, admin.updater.Status())
+}
+
+func (admin *Admin) handleAddPairs(
+	response http.ResponseWriter,
+	request *http.Request,
+) {
+	if admin.updater == nil {
+		writeError(response, http.StatusServiceUnavailable, errReadOnly)
+		return
+	}
+
+	pairs, err := parsePairs(request.URL.Query().Get("pairs"))
+	if err != nil || len(pairs) == 0 {
+		writeError(response, http.StatusBadRequest, errPairsInvalid(err))
+		return
+	}
+
+	err = admin.updater.Add(request.Context(), pairs)
+	if err != nil {
+		writeError(response, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(response, http.StatusOK, admin.updater.Status())
+}
+
+func (admin *Admin) handleRemovePairs(
+	response http.ResponseWriter,
+	request *http.Request,
+) {
+	if admin.updater == nil {
+		writeError(response, http.StatusServiceUnavailable, errReadOnly)
+		return
+	}
+
+	pairs, err := parsePairs(request.URL.Query().Get("pairs"))
+	if err != nil || len(pairs) == 0 {
+		writeError(response, http.StatusBadRequest, errPairsInvalid(err))
+		return
+	}
+
+	err = admin.updater.Remove(request.Context(), pairs)
+	if err != nil {
+		writeError(response, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(response, http.StatusOK, admin.updater.Status())
+}
+
+// handlePurge deletes the cache entries of the given pairs and the entries
+// having any of the given symbols as either fsym or tsym.
+func (admin *Admin) handlePurge(
+	response http.ResponseWriter,
+	request *http.Request,
+) {
+	query := request.URL.Query()
+
+	pairs, err := parsePairs(query.Get("pairs"))
+	if err != nil {
+		writeError(response, http.StatusBadRequest, errPairsInvalid(err))
+		return
+	}
+
+	symbols := []string{}
+	for _, symbol := range strings.Split(query.Get("symbols"), ",") {
+		if symbol != "" {
+			symbols = append(symbols, symbol)
+		}
+	}
+
+	if len(pairs) == 0 && len(symbols) == 0 {
+		writeError(response, http.StatusBadRequest, errPurgeEmpty)
+		return
+	}
+
+	// every pair and every symbol is a pattern of cache.Delete
+	patterns := [][2]string{}
+	for _, pair := range pairs {
+		patterns = append(patterns, [2]string{pair.Fsym, pair.Tsym})
+	}
+
+	for _, symbol := range symbols {
+		patterns = append(
+			patterns,
+			[2]string{symbol, ""},
+			[2]string{"", symbol},
+		)
+	}
+
+	deleted := 0
+	for _, pattern := range patterns {
+		count, err := admin.cache.Delete(
+			request.Context(),
+			pattern[0],
+			pattern[1],
+		)
+		if err != nil {
+			writeError(response, http.StatusInternalServerError, err)
+			return
+		}
+
+		deleted += count
+	}
+
+	log.Infof(nil, "admin: purged %d cache entries", deleted)
+
+	writeJSON(response, http.StatusOK, struct {
+		Deleted int `json:"deleted"`
+	}{Deleted: deleted})
+}
+
+// handleRefresh updates the given pairs immediately, all pairs refreshed by
+// the updater are updated if none are given.
+func (admin *Admin) handleRefresh(
+	response http.ResponseWriter,
+	request *http.Request,
+) {
+	if admin.updater == nil {
+		writeError(response, http.StatusServiceUnavailable, errReadOnly)
+		return
+	}
+
+	pairs, err := parsePairs(request.URL.Query().Get("pairs"))
+	if err != nil {
+		writeError(response, http.StatusBadRequest, errPairsInvalid(err))
+		return
+	}
+
+	for _, pair := range pairs {
+		if !admin.updater.Tracks(pair) {
+			writeError(
+				response,
+				http.StatusBadRequest,
+				fmt.Errorf("%s is not refreshed by the updater", pair),
+			)
+			return
+		}
+	}
+
+	err = admin.updater.Refresh(request.Context(), pairs)
+	if err != nil {
+		writeError(response, http.StatusBadGateway, err)
+		return
+	}
+
+	writeJSON(response, http.StatusOK, admin.updater.Status())
+}
+
+// parsePairs parses a comma-separated list of pairs in the FSYM/TSYM form.
+func parsePairs(value string) ([]cryptocompare.Pair, error) {
+	pairs := []cryptocompare.Pair{}
+	for _, item := range strings.Split(value, ",") {
+		if item == "" {
+			continue
+		}
+
+		pair, err := cryptocompare.ParsePair(item)
+		if err != nil {
+			return nil, err
+		}
+
+		pairs = append(pairs, pair)
+	}
+
+	return pairs, nil
+}
+
+func errPairsInvalid(err error) error {
+	if err == nil {
+		return errors.New("pairs param is empty")
+	}
+
+	return karma.Format(err, "pairs param is invalid")
+}
+
+func writeJSON(response http.ResponseWriter, status int, msg interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+
+	err := json.NewEncoder(response).Encode(msg)
+	if err != nil {
+		log.Errorf(err, "admin: write json")
+	}
+}
+
+func writeError(response http.ResponseWriter, status int, err error) {
+	log.Error(err)
+
+	writeJSON(response, status, struct {
+		Error string `json:"error"`
+	}{Error: err.Error()})
+}
@@ -0,0 +1,181 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cache"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/updater"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClient returns prices of all requested pairs.
+type fakeClient struct{}
+
+func (client *fakeClient) GetPriceList(
+	ctx context.Context,
+	fsyms []string,
+	tsyms []string,
+) (*cryptocompare.PriceList, error) {
+	list := &cryptocompare.PriceList{
+		Raw:     map[string]map[string]cryptocompare.RawPrice{},
+		Display: map[string]map[string]cryptocompare.DisplayPrice{},
+	}
+
+	for _, fsym := range fsyms {
+		list.Raw[fsym] = map[string]cryptocompare.RawPrice{}
+		list.Display[fsym] = map[string]cryptocompare.DisplayPrice{}
+
+		for _, tsym := range tsyms {
+			list.Raw[fsym][tsym] = cryptocompare.RawPrice{Price: 1}
+			list.Display[fsym][tsym] = cryptocompare.DisplayPrice{Price: "1"}
+		}
+	}
+
+	return list, nil
+}
+
+func newTestAdmin(t *testing.T) (*Admin, cache.Cache) {
+	storage, err := cache.New(cache.BackendMemory, "", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.Boot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refresher, err := updater.New(
+		&fakeClient{},
+		4,
+		storage,
+		[]updater.Group{
+			updater.CrossGroup("", []string{"BTC"}, []string{"USD"}),
+		},
+		30,
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err := New(":0", "secret", storage, refresher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return admin, storage
+}
+
+func do(admin *Admin, method string, uri string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, uri, nil)
+	request.Header.Set("Authorization", "Bearer secret")
+
+	response := httptest.NewRecorder()
+	admin.ServeHTTP(response, request)
+
+	return response
+}
+
+func TestAdmin_RejectsInvalidToken(t *testing.T) {
+	test := assert.New(t)
+
+	admin, _ := newTestAdmin(t)
+
+	// the token is accepted with the Bearer scheme only
+	for _, header := range []string{"Bearer wrong", "secret", ""} {
+		request := httptest.NewRequest(http.MethodGet, pairsPath, nil)
+		request.Header.Set("Authorization", header)
+
+		response := httptest.NewRecorder()
+		admin.ServeHTTP(response, request)
+
+		test.Equal(http.StatusUnauthorized, response.Code, header)
+	}
+}
+
+func TestAdmin_Close_BeforeListening(t *testing.T) {
+	admin, _ := newTestAdmin(t)
+
+	assert.NoError(t, admin.Close())
+}
+
+func TestAdmin_AddsAndRemovesPairs(t *testing.T) {
+	test := assert.New(t)
+
+	admin, storage := newTestAdmin(t)
+
+	response := do(admin, http.MethodPost, pairsPath+"?pairs=ETH/EUR")
+	test.Equal(http.StatusOK, response.Code)
+
+	var statuses []updater.PairStatus
+	test.NoError(json.Unmarshal(response.Body.Bytes(), &statuses))
+	if test.Len(statuses, 2) {
+		test.Equal("ETH", statuses[1].Fsym)
+		test.Equal(updater.SourceAdmin, statuses[1].Source)
+	}
+
+	watches, err := storage.ReadWatchlist(context.Background())
+	test.NoError(err)
+	test.Len(watches, 1)
+
+	// the configured pairs can't be removed
+	response = do(admin, http.MethodDelete, pairsPath+"?pairs=BTC/USD")
+	test.Equal(http.StatusBadRequest, response.Code)
+
+	response = do(admin, http.MethodDelete, pairsPath+"?pairs=ETH/EUR")
+	test.Equal(http.StatusOK, response.Code)
+
+	watches, err = storage.ReadWatchlist(context.Background())
+	test.NoError(err)
+	test.Len(watches, 0)
+
+	response = do(admin, http.MethodPost, pairsPath+"?pairs=ETH")
+	test.Equal(http.StatusBadRequest, response.Code)
+}
+
+func TestAdmin_RefreshesAndPurgesPairs(t *testing.T) {
+	test := assert.New(t)
+
+	admin, storage := newTestAdmin(t)
+
+	response := do(admin, http.MethodPost, refreshPath+"?pairs=BTC/USD")
+	test.Equal(http.StatusOK, response.Code)
+
+	entities, err := storage.Read(
+		context.Background(),
+		[]string{"BTC"},
+		[]string{"USD"},
+		60,
+	)
+	test.NoError(err)
+	test.Len(entities, 1)
+
+	// only the tracked pairs can be refreshed
+	response = do(admin, http.MethodPost, refreshPath+"?pairs=ETH/USD")
+	test.Equal(http.StatusBadRequest, response.Code)
+
+	err = storage.Write(
+		context.Background(),
+		time.Now(),
+		"ETH",
+		"BTC",
+		cryptocompare.RawPrice{Price: 1},
+		cryptocompare.DisplayPrice{Price: "1"},
+	)
+	test.NoError(err)
+
+	response = do(admin, http.MethodPost, purgePath+"?symbols=BTC")
+	test.Equal(http.StatusOK, response.Code)
+	test.JSONEq(`{"deleted": 2}`, response.Body.String())
+
+	response = do(admin, http.MethodPost, purgePath)
+	test.Equal(http.StatusBadRequest, response.Code)
+}
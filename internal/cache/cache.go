@@ -2,6 +2,7 @@ package cache
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
@@ -25,6 +26,14 @@ type Cache interface {
 		ttl int,
 	) ([]Entity, error)
 
+	// ReadStale returns a list of entities by the given symbols regardless of
+	// their age, the age can be determined by StoredAt() of the entities.
+	ReadStale(
+		ctx context.Context,
+		fromSymbols []string,
+		toSymbols []string,
+	) ([]Entity, error)
+
 	// Write saves the specified data into the internal storage.
 	Write(
 		ctx context.Context,
@@ -34,19 +43,61 @@ type Cache interface {
 		raw cryptocompare.RawPrice,
 		display cryptocompare.DisplayPrice,
 	) error
+
+	// Delete removes the entities of the given symbols, an empty symbol
+	// matches any symbol. Returns the number of removed entities.
+	Delete(
+		ctx context.Context,
+		fromSymbol string,
+		toSymbol string,
+	) (int, error)
+
+	Watchlist
+
+	Lease
+
+	Membership
 }
 
-// New instance of cache, currently postgres supported only.
+const (
+	// BackendPostgres stores entries in a postgres database.
+	BackendPostgres = "postgres"
+
+	// BackendMemory stores entries in the process memory.
+	BackendMemory = "memory"
+
+	// BackendSQLite stores entries in a sqlite database file.
+	BackendSQLite = "sqlite"
+)
+
+// New instance of cache of the given backend, the database parameters are
+// used by the postgres backend only, path is used by the sqlite backend only.
 func New(
+	backend string,
 	address string,
 	database string,
 	username string,
 	password string,
+	path string,
 ) (Cache, error) {
-	return &postgres{
-		address:  address,
-		database: database,
-		username: username,
-		password: password,
-	}, nil
+	switch backend {
+	case BackendPostgres:
+		return &postgres{
+			address:  address,
+			database: database,
+			username: username,
+			password: password,
+		}, nil
+
+	case BackendMemory:
+		return &memory{}, nil
+
+	case BackendSQLite:
+		return &sqlite{
+			path: path,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported cache backend: %q", backend)
+	}
 }
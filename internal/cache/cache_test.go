@@ -0,0 +1,397 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCache is a behavioural test suite every Cache implementation is
+// expected to pass.
+func testCache(t *testing.T, cache Cache) {
+	t.Run("Read_ReturnsWrittenEntities", func(t *testing.T) {
+		test := assert.New(t)
+
+		ctx := context.Background()
+
+		err := cache.Write(
+			ctx,
+			time.Now(),
+			"BTC",
+			"USD",
+			cryptocompare.RawPrice{Price: 1},
+			cryptocompare.DisplayPrice{Price: "$ 1"},
+		)
+		test.NoError(err)
+
+		err = cache.Write(
+			ctx,
+			time.Now(),
+			"ETH",
+			"USD",
+			cryptocompare.RawPrice{Price: 2},
+			cryptocompare.DisplayPrice{Price: "$ 2"},
+		)
+		test.NoError(err)
+
+		entities, err := cache.Read(ctx, []string{"BTC"}, []string{"USD"}, 60)
+		test.NoError(err)
+
+		if test.Len(entities, 1) {
+			test.Equal("BTC", entities[0].FromSymbol())
+			test.Equal("USD", entities[0].ToSymbol())
+			test.Equal(1.0, entities[0].RawPrice().Price)
+			test.Equal("$ 1", entities[0].DisplayPrice().Price)
+		}
+	})
+
+	t.Run("Write_OverwritesPair", func(t *testing.T) {
+		test := assert.New(t)
+
+		ctx := context.Background()
+
+		for _, price := range []float64{10, 20} {
+			err := cache.Write(
+				ctx,
+				time.Now(),
+				"BTC",
+				"EUR",
+				cryptocompare.RawPrice{Price: price},
+				cryptocompare.DisplayPrice{},
+			)
+			test.NoError(err)
+		}
+
+		entities, err := cache.Read(ctx, []string{"BTC"}, []string{"EUR"}, 60)
+		test.NoError(err)
+
+		if test.Len(entities, 1) {
+			test.Equal(20.0, entities[0].RawPrice().Price)
+		}
+	})
+
+	t.Run("Read_SkipsExpiredEntities", func(t *testing.T) {
+		test := assert.New(t)
+
+		ctx := context.Background()
+
+		err := cache.Write(
+			ctx,
+			time.Now().Add(-time.Minute),
+			"DOGE",
+			"USD",
+			cryptocompare.RawPrice{Price: 3},
+			cryptocompare.DisplayPrice{},
+		)
+		test.NoError(err)
+
+		entities, err := cache.Read(ctx, []string{"DOGE"}, []string{"USD"}, 30)
+		test.NoError(err)
+		test.Len(entities, 0)
+
+		entities, err = cache.Read(ctx, []string{"DOGE"}, []string{"USD"}, 120)
+		test.NoError(err)
+		test.Len(entities, 1)
+	})
+
+	t.Run("ReadStale_ReturnsExpiredEntities", func(t *testing.T) {
+		test := assert.New(t)
+
+		ctx := context.Background()
+
+		at := time.Now().Add(-time.Hour)
+
+		err := cache.Write(
+			ctx,
+			at,
+			"XRP",
+			"USD",
+			cryptocompare.RawPrice{Price: 4},
+			cryptocompare.DisplayPrice{},
+		)
+		test.NoError(err)
+
+		entities, err := cache.ReadStale(ctx, []string{"XRP"}, []string{"USD"})
+		test.NoError(err)
+
+		if test.Len(entities, 1) {
+			test.Equal(4.0, entities[0].RawPrice().Price)
+			test.WithinDuration(at, entities[0].StoredAt(), time.Second)
+		}
+	})
+
+	t.Run("Delete_RemovesMatchingEntities", func(t *testing.T) {
+		test := assert.New(t)
+
+		ctx := context.Background()
+
+		for _, pair := range [][2]string{
+			{"DELA", "DELX"},
+			{"DELA", "DELY"},
+			{"DELB", "DELX"},
+		} {
+			err := cache.Write(
+				ctx,
+				time.Now(),
+				pair[0],
+				pair[1],
+				cryptocompare.RawPrice{Price: 1},
+				cryptocompare.DisplayPrice{Price: "1"},
+			)
+			test.NoError(err)
+		}
+
+		deleted, err := cache.Delete(ctx, "DELA", "DELX")
+		test.NoError(err)
+		test.Equal(1, deleted)
+
+		deleted, err = cache.Delete(ctx, "", "DELX")
+		test.NoError(err)
+		test.Equal(1, deleted)
+
+		entities, err := cache.ReadStale(
+			ctx,
+			[]string{"DELA", "DELB"},
+			[]string{"DELX", "DELY"},
+		)
+		test.NoError(err)
+		if test.Len(entities, 1) {
+			test.Equal("DELY", entities[0].ToSymbol())
+		}
+	})
+
+	t.Run("Lease_IsHeldBySingleHolder", func(t *testing.T) {
+		test := assert.New(t)
+
+		ctx := context.Background()
+
+		at := time.Now()
+
+		acquired, err := cache.AcquireLease(ctx, "test", "a", at, time.Minute)
+		test.NoError(err)
+		test.True(acquired)
+
+		acquired, err = cache.AcquireLease(ctx, "test", "b", at, time.Minute)
+		test.NoError(err)
+		test.False(acquired)
+
+		// renewed by the holder
+		acquired, err = cache.AcquireLease(ctx, "test", "a", at, time.Minute)
+		test.NoError(err)
+		test.True(acquired)
+
+		// taken over once it has expired
+		later := at.Add(2 * time.Minute)
+		acquired, err = cache.AcquireLease(ctx, "test", "b", later, time.Minute)
+		test.NoError(err)
+		test.True(acquired)
+
+		// released by the holder only
+		test.NoError(cache.ReleaseLease(ctx, "test", "a"))
+
+		acquired, err = cache.AcquireLease(ctx, "test", "a", later, time.Minute)
+		test.NoError(err)
+		test.False(acquired)
+
+		test.NoError(cache.ReleaseLease(ctx, "test", "b"))
+
+		acquired, err = cache.AcquireLease(ctx, "test", "a", later, time.Minute)
+		test.NoError(err)
+		test.True(acquired)
+	})
+
+	t.Run("Membership_ListsAnnouncedMembers", func(t *testing.T) {
+		test := assert.New(t)
+
+		ctx := context.Background()
+
+		at := time.Now()
+
+		test.NoError(cache.WriteMember(ctx, "b", at, time.Minute))
+		test.NoError(cache.WriteMember(ctx, "a", at, time.Minute))
+		test.NoError(cache.WriteMember(ctx, "c", at, time.Second))
+
+		members, err := cache.ReadMembers(ctx, at)
+		test.NoError(err)
+		test.Equal([]string{"a", "b", "c"}, members)
+
+		// the expired announcement is ignored
+		members, err = cache.ReadMembers(ctx, at.Add(time.Second*2))
+		test.NoError(err)
+		test.Equal([]string{"a", "b"}, members)
+
+		test.NoError(cache.DeleteMember(ctx, "a"))
+		test.NoError(cache.DeleteMember(ctx, "b"))
+		test.NoError(cache.DeleteMember(ctx, "c"))
+
+		members, err = cache.ReadMembers(ctx, at)
+		test.NoError(err)
+		test.Empty(members)
+	})
+
+	t.Run("Watchlist_AddsAndRemovesPairs", func(t *testing.T) {
+		test := assert.New(t)
+
+		ctx := context.Background()
+
+		at := time.Now()
+
+		test.NoError(cache.WriteWatch(ctx, at, "BTC", "USD", "demand"))
+		test.NoError(cache.WriteWatch(ctx, at, "BTC", "USD", "admin"))
+		test.NoError(cache.WriteWatch(ctx, at, "ETH", "USD", "demand"))
+
+		// updates the time only
+		later := at.Add(time.Minute)
+		test.NoError(cache.WriteWatch(ctx, later, "ETH", "USD", "demand"))
+
+		test.NoError(cache.DeleteWatch(ctx, "BTC", "USD", "demand"))
+
+		watches, err := cache.ReadWatchlist(ctx)
+		test.NoError(err)
+
+		found := map[string]time.Time{}
+		for _, watch := range watches {
+			key := watch.FromSymbol() + "/" + watch.ToSymbol() + "@" +
+				watch.Source()
+
+			found[key] = watch.SeenAt()
+		}
+
+		test.Len(found, 2)
+		test.Contains(found, "BTC/USD@admin")
+		test.WithinDuration(later, found["ETH/USD@demand"], time.Second)
+
+		// the pair seen since the given time is kept
+		test.NoError(
+			cache.DeleteWatchSeenBefore(ctx, "ETH", "USD", "demand", at),
+		)
+
+		watches, err = cache.ReadWatchlist(ctx)
+		test.NoError(err)
+		test.Len(watches, 2)
+
+		test.NoError(cache.DeleteWatchSeenBefore(
+			ctx,
+			"ETH",
+			"USD",
+			"demand",
+			later.Add(time.Second),
+		))
+
+		watches, err = cache.ReadWatchlist(ctx)
+		test.NoError(err)
+		test.Len(watches, 1)
+	})
+}
+
+func TestMemory(t *testing.T) {
+	cache, err := New(BackendMemory, "", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cache.Boot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer cache.Close()
+
+	testCache(t, cache)
+}
+
+func TestSQLite(t *testing.T) {
+	cache, err := New(
+		BackendSQLite,
+		"",
+		"",
+		"",
+		"",
+		filepath.Join(t.TempDir(), "cache.db"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cache.Boot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer cache.Close()
+
+	testCache(t, cache)
+}
+
+func TestPostgres(t *testing.T) {
+	address := os.Getenv("TEST_DATABASE_ADDRESS")
+	if address == "" {
+		t.Skip("TEST_DATABASE_ADDRESS is not specified")
+	}
+
+	cache, err := New(
+		BackendPostgres,
+		address,
+		"cryptocompare-proxyd-dev",
+		"cryptocompare-proxyd-dev",
+		"cryptocompare-proxyd-dev",
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cache.Boot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer cache.Close()
+
+	testCache(t, cache)
+}
+
+func TestNotification_LeavesOutPriceNotFittingPayload(t *testing.T) {
+	test := assert.New(t)
+
+	now := time.Now()
+
+	payload, err := notification(
+		now,
+		"BTC",
+		"USD",
+		cryptocompare.RawPrice{Price: 1},
+		cryptocompare.DisplayPrice{Price: "$ 1"},
+	)
+	test.NoError(err)
+
+	var small Notification
+	test.NoError(json.Unmarshal(payload, &small))
+	if test.NotNil(small.Raw) && test.NotNil(small.Display) {
+		test.Equal(1.0, small.Raw.Price)
+		test.Equal("$ 1", small.Display.Price)
+	}
+
+	payload, err = notification(
+		now,
+		"BTC",
+		"USD",
+		cryptocompare.RawPrice{Price: 1},
+		cryptocompare.DisplayPrice{Price: strings.Repeat("$", 8000)},
+	)
+	test.NoError(err)
+	test.LessOrEqual(len(payload), maxNotifyPayload)
+
+	var large Notification
+	test.NoError(json.Unmarshal(payload, &large))
+	test.Equal("BTC", large.Fsym)
+	test.Nil(large.Raw)
+	test.Nil(large.Display)
+}
@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// Lease is a named lock shared by the instances using the same storage, it's
+// held by a single holder until it expires. The holders are expected to have
+// their clocks in sync.
+type Lease interface {
+	// AcquireLease acquires or renews the lease of the given name on behalf
+	// of the given holder until at+ttl. Returns false if the lease is held by
+	// another holder and hasn't expired yet.
+	AcquireLease(
+		ctx context.Context,
+		name string,
+		holder string,
+		at time.Time,
+		ttl time.Duration,
+	) (bool, error)
+
+	// ReleaseLease releases the lease of the given name if it's held by the
+	// given holder.
+	ReleaseLease(ctx context.Context, name string, holder string) error
+}
+
+type lease struct {
+	bun.BaseModel `bun:"table:leases,alias:l"`
+
+	Name string `bun:"name,pk"`
+
+	Holder string `bun:"holder"`
+
+	ExpiresAt time.Time `bun:"expires_at,type:timestamp"`
+}
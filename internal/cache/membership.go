@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// Membership is a list of the instances sharing the storage, every instance
+// announces itself periodically and is considered gone once its announcement
+// expires. The instances are expected to have their clocks in sync.
+type Membership interface {
+	// WriteMember announces the given member until at+ttl.
+	WriteMember(
+		ctx context.Context,
+		member string,
+		at time.Time,
+		ttl time.Duration,
+	) error
+
+	// ReadMembers returns the members which announcements haven't expired
+	// by the given time, sorted by name.
+	ReadMembers(ctx context.Context, at time.Time) ([]string, error)
+
+	// DeleteMember removes the given member, so it's gone without waiting
+	// for its announcement to expire.
+	DeleteMember(ctx context.Context, member string) error
+}
+
+type member struct {
+	bun.BaseModel `bun:"table:members,alias:m"`
+
+	Name string `bun:"name,pk"`
+
+	ExpiresAt time.Time `bun:"expires_at,type:timestamp"`
+}
@@ -0,0 +1,298 @@
+package cache
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+)
+
+// We make sure memory implements the Cache interface.
+var _ Cache = (*memory)(nil)
+
+// memory keeps entries in the process memory, the entries are lost on
+// restart. It's meant for development, tests and small deployments.
+type memory struct {
+	mutex    sync.RWMutex
+	entities map[cryptocompare.Pair]entity
+	watches  map[watchKey]watch
+	leases   map[string]lease
+	members  map[string]time.Time
+}
+
+type watchKey struct {
+	pair   cryptocompare.Pair
+	source string
+}
+
+func (memory *memory) Boot() error {
+	memory.entities = map[cryptocompare.Pair]entity{}
+	memory.watches = map[watchKey]watch{}
+	memory.leases = map[string]lease{}
+	memory.members = map[string]time.Time{}
+
+	return nil
+}
+
+func (memory *memory) Close() {
+	//
+}
+
+func (memory *memory) Write(
+	ctx context.Context,
+	at time.Time,
+	fromSymbol string,
+	toSymbol string,
+	raw cryptocompare.RawPrice,
+	display cryptocompare.DisplayPrice,
+) error {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	pair := cryptocompare.Pair{Fsym: fromSymbol, Tsym: toSymbol}
+
+	memory.entities[pair] = entity{
+		At:      at,
+		Fsym:    fromSymbol,
+		Tsym:    toSymbol,
+		Raw:     raw,
+		Display: display,
+	}
+
+	return nil
+}
+
+func (memory *memory) Delete(
+	ctx context.Context,
+	fromSymbol string,
+	toSymbol string,
+) (int, error) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	deleted := 0
+	for pair := range memory.entities {
+		if fromSymbol != "" && pair.Fsym != fromSymbol {
+			continue
+		}
+
+		if toSymbol != "" && pair.Tsym != toSymbol {
+			continue
+		}
+
+		delete(memory.entities, pair)
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+func (memory *memory) Read(
+	ctx context.Context,
+	fromSymbols []string,
+	toSymbols []string,
+	ttl int,
+) ([]Entity, error) {
+	// the same condition as in postgres: at > NOW() - ttl
+	threshold := time.Now().Add(-time.Duration(ttl) * time.Second)
+
+	return memory.read(fromSymbols, toSymbols, threshold), nil
+}
+
+func (memory *memory) ReadStale(
+	ctx context.Context,
+	fromSymbols []string,
+	toSymbols []string,
+) ([]Entity, error) {
+	return memory.read(fromSymbols, toSymbols, time.Time{}), nil
+}
+
+// read returns entities stored after the given threshold, zero threshold
+// means any entity.
+func (memory *memory) read(
+	fromSymbols []string,
+	toSymbols []string,
+	threshold time.Time,
+) []Entity {
+	memory.mutex.RLock()
+	defer memory.mutex.RUnlock()
+
+	result := []Entity{}
+	for _, fsym := range fromSymbols {
+		for _, tsym := range toSymbols {
+			pair := cryptocompare.Pair{Fsym: fsym, Tsym: tsym}
+
+			entity, ok := memory.entities[pair]
+			if !ok {
+				continue
+			}
+
+			if !threshold.IsZero() && !entity.At.After(threshold) {
+				continue
+			}
+
+			result = append(result, Entity(entity))
+		}
+	}
+
+	return result
+}
+
+func (memory *memory) ReadWatchlist(ctx context.Context) ([]Watch, error) {
+	memory.mutex.RLock()
+	defer memory.mutex.RUnlock()
+
+	result := []Watch{}
+	for _, watch := range memory.watches {
+		result = append(result, Watch(watch))
+	}
+
+	return result, nil
+}
+
+func (memory *memory) WriteWatch(
+	ctx context.Context,
+	at time.Time,
+	fromSymbol string,
+	toSymbol string,
+	source string,
+) error {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	key := watchKey{
+		pair:   cryptocompare.Pair{Fsym: fromSymbol, Tsym: toSymbol},
+		source: source,
+	}
+
+	memory.watches[key] = watch{
+		At:   at,
+		Fsym: fromSymbol,
+		Tsym: toSymbol,
+		From: source,
+	}
+
+	return nil
+}
+
+func (memory *memory) DeleteWatch(
+	ctx context.Context,
+	fromSymbol string,
+	toSymbol string,
+	source string,
+) error {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	delete(memory.watches, watchKey{
+		pair:   cryptocompare.Pair{Fsym: fromSymbol, Tsym: toSymbol},
+		source: source,
+	})
+
+	return nil
+}
+
+func (memory *memory) DeleteWatchSeenBefore(
+	ctx context.Context,
+	fromSymbol string,
+	toSymbol string,
+	source string,
+	before time.Time,
+) error {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	key := watchKey{
+		pair:   cryptocompare.Pair{Fsym: fromSymbol, Tsym: toSymbol},
+		source: source,
+	}
+
+	if watch, ok := memory.watches[key]; ok && watch.At.Before(before) {
+		delete(memory.watches, key)
+	}
+
+	return nil
+}
+
+func (memory *memory) AcquireLease(
+	ctx context.Context,
+	name string,
+	holder string,
+	at time.Time,
+	ttl time.Duration,
+) (bool, error) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	current, ok := memory.leases[name]
+	if ok && current.Holder != holder && !current.ExpiresAt.Before(at) {
+		return false, nil
+	}
+
+	memory.leases[name] = lease{
+		Name:      name,
+		Holder:    holder,
+		ExpiresAt: at.Add(ttl),
+	}
+
+	return true, nil
+}
+
+func (memory *memory) ReleaseLease(
+	ctx context.Context,
+	name string,
+	holder string,
+) error {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	if current, ok := memory.leases[name]; ok && current.Holder == holder {
+		delete(memory.leases, name)
+	}
+
+	return nil
+}
+
+func (memory *memory) WriteMember(
+	ctx context.Context,
+	name string,
+	at time.Time,
+	ttl time.Duration,
+) error {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	memory.members[name] = at.Add(ttl)
+
+	return nil
+}
+
+func (memory *memory) ReadMembers(
+	ctx context.Context,
+	at time.Time,
+) ([]string, error) {
+	memory.mutex.RLock()
+	defer memory.mutex.RUnlock()
+
+	members := []string{}
+	for name, expiresAt := range memory.members {
+		if !expiresAt.Before(at) {
+			members = append(members, name)
+		}
+	}
+
+	sort.Strings(members)
+
+	return members, nil
+}
+
+func (memory *memory) DeleteMember(ctx context.Context, name string) error {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+
+	delete(memory.members, name)
+
+	return nil
+}
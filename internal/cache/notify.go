@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+)
+
+// Notification tells the price of the pair has been written into the storage
+// by any instance sharing it.
+type Notification struct {
+	Fsym string    `json:"fsym"`
+	Tsym string    `json:"tsym"`
+	At   time.Time `json:"at"`
+
+	// Raw and Display are the written price, they are nil if the price
+	// doesn't fit the notification, so it should be read from the storage.
+	Raw     *cryptocompare.RawPrice     `json:"raw,omitempty"`
+	Display *cryptocompare.DisplayPrice `json:"display,omitempty"`
+}
+
+// Notifier is implemented by the storages telling every instance sharing the
+// storage about the written prices.
+type Notifier interface {
+	// Listen calls notify with every written price until the given context
+	// is cancelled. The connection is re-established once it's lost, then
+	// resume is called with the time the connection was lost at, so the
+	// notifications missed in the meantime can be caught up.
+	Listen(
+		ctx context.Context,
+		notify func(Notification),
+		resume func(lostAt time.Time),
+	)
+
+	// ReadSince returns the entities written at or after the given time.
+	ReadSince(ctx context.Context, at time.Time) ([]Entity, error)
+}
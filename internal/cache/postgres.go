@@ -3,6 +3,7 @@ package cache
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -14,8 +15,24 @@ import (
 	"github.com/uptrace/bun/driver/pgdriver"
 )
 
-// We make sure postgres implements the Cache interface.
-var _ Cache = (*postgres)(nil)
+// We make sure postgres implements the Cache and Notifier interfaces.
+var (
+	_ Cache    = (*postgres)(nil)
+	_ Notifier = (*postgres)(nil)
+)
+
+const (
+	// notifyChannel is a channel the written prices are notified on.
+	notifyChannel = "pricelist"
+
+	// maxNotifyPayload is a maximum size (bytes) of a notification payload
+	// accepted by postgres, the payload must be shorter than 8000 bytes.
+	maxNotifyPayload = 7999
+
+	// listenRetryInterval is a duration of time to wait before listening
+	// again once the connection is lost.
+	listenRetryInterval = 5 * time.Second
+)
 
 type postgres struct {
 	address  string
@@ -45,16 +62,25 @@ func (postgres *postgres) Boot() error {
 	//
 	// db.AddQueryHook(bundebug.NewQueryHook(bundebug.WithVerbose(true)))
 
-	db.RegisterModel((*entity)(nil))
+	models := []interface{}{
+		(*entity)(nil),
+		(*watch)(nil),
+		(*lease)(nil),
+		(*member)(nil),
+	}
+
+	db.RegisterModel(models...)
 
 	log.Debugf(nil, "postgres: ensure table schema")
 
-	_, err := db.NewCreateTable().
-		Model((*entity)(nil)).
-		IfNotExists().
-		Exec(context.Background())
-	if err != nil {
-		return karma.Format(err, "postgres: create/ensure table")
+	for _, model := range models {
+		_, err := db.NewCreateTable().
+			Model(model).
+			IfNotExists().
+			Exec(context.Background())
+		if err != nil {
+			return karma.Format(err, "postgres: create/ensure table")
+		}
 	}
 
 	postgres.db = db
@@ -88,26 +114,208 @@ func (postgres *postgres) Write(
 		return karma.Format(err, "postgres: insert")
 	}
 
+	payload, err := notification(at, fromSymbol, toSymbols, raw, display)
+	if err != nil {
+		return karma.Format(err, "postgres: marshal notification")
+	}
+
+	// the price is written anyway, the other instances catch it up once
+	// they reconnect
+	err = pgdriver.Notify(ctx, postgres.db, notifyChannel, string(payload))
+	if err != nil {
+		log.Errorf(
+			err,
+			"postgres: unable to notify about %s/%s",
+			fromSymbol,
+			toSymbols,
+		)
+	}
+
 	return nil
 }
 
+// notification returns the payload of the notification about the given
+// price, the price itself is left out if the payload doesn't fit postgres
+// limits, so the listeners read it from the storage.
+func notification(
+	at time.Time,
+	fromSymbol string,
+	toSymbol string,
+	raw cryptocompare.RawPrice,
+	display cryptocompare.DisplayPrice,
+) ([]byte, error) {
+	payload, err := json.Marshal(Notification{
+		Fsym:    fromSymbol,
+		Tsym:    toSymbol,
+		At:      at,
+		Raw:     &raw,
+		Display: &display,
+	})
+	if err != nil || len(payload) <= maxNotifyPayload {
+		return payload, err
+	}
+
+	return json.Marshal(Notification{
+		Fsym: fromSymbol,
+		Tsym: toSymbol,
+		At:   at,
+	})
+}
+
+func (postgres *postgres) Delete(
+	ctx context.Context,
+	fromSymbol string,
+	toSymbol string,
+) (int, error) {
+	result, err := postgres.db.NewDelete().
+		Model((*entity)(nil)).
+		Where("(? = '' OR fsym = ?)", fromSymbol, fromSymbol).
+		Where("(? = '' OR tsym = ?)", toSymbol, toSymbol).
+		Exec(ctx)
+	if err != nil {
+		return 0, karma.Format(err, "postgres: delete")
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, karma.Format(err, "postgres: delete: rows affected")
+	}
+
+	return int(deleted), nil
+}
+
 func (postgres *postgres) Read(
 	ctx context.Context,
 	fromSymbols []string,
 	toSymbolss []string,
 	ttl int,
+) ([]Entity, error) {
+	return postgres.read(
+		ctx,
+		postgres.db.NewSelect().
+			Model((*entity)(nil)).
+			Where(
+				"fsym IN (?) AND tsym IN (?) AND at > NOW() - INTERVAL '?'",
+				bun.In(fromSymbols),
+				bun.In(toSymbolss),
+				ttl,
+			),
+	)
+}
+
+func (postgres *postgres) ReadStale(
+	ctx context.Context,
+	fromSymbols []string,
+	toSymbols []string,
+) ([]Entity, error) {
+	return postgres.read(
+		ctx,
+		postgres.db.NewSelect().
+			Model((*entity)(nil)).
+			Where(
+				"fsym IN (?) AND tsym IN (?)",
+				bun.In(fromSymbols),
+				bun.In(toSymbols),
+			),
+	)
+}
+
+func (postgres *postgres) ReadSince(
+	ctx context.Context,
+	at time.Time,
+) ([]Entity, error) {
+	return postgres.read(
+		ctx,
+		postgres.db.NewSelect().
+			Model((*entity)(nil)).
+			Where("at >= ?", at),
+	)
+}
+
+func (postgres *postgres) Listen(
+	ctx context.Context,
+	notify func(Notification),
+	resume func(lostAt time.Time),
+) {
+	listener := pgdriver.NewListener(postgres.db)
+	defer listener.Close()
+
+	var lostAt time.Time
+	for {
+		err := listener.Listen(ctx, notifyChannel)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			if lostAt.IsZero() {
+				lostAt = time.Now()
+			}
+
+			log.Errorf(err, "postgres: unable to listen for notifications")
+
+			if !sleep(ctx, listenRetryInterval) {
+				return
+			}
+
+			continue
+		}
+
+		if !lostAt.IsZero() {
+			log.Infof(nil, "postgres: listening for notifications again")
+
+			resume(lostAt)
+			lostAt = time.Time{}
+		}
+
+		for {
+			_, payload, err := listener.Receive(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+
+				lostAt = time.Now()
+
+				log.Errorf(err, "postgres: unable to receive notifications")
+
+				break
+			}
+
+			var notification Notification
+			err = json.Unmarshal([]byte(payload), &notification)
+			if err != nil {
+				log.Errorf(err, "postgres: invalid notification: %q", payload)
+				continue
+			}
+
+			notify(notification)
+		}
+
+		if !sleep(ctx, listenRetryInterval) {
+			return
+		}
+	}
+}
+
+// sleep waits for the given duration of time, returns false if the context
+// is cancelled in the meantime.
+func sleep(ctx context.Context, duration time.Duration) bool {
+	select {
+	case <-time.After(duration):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (postgres *postgres) read(
+	ctx context.Context,
+	query *bun.SelectQuery,
 ) ([]Entity, error) {
 	entities := []entity{}
 
-	err := postgres.db.NewSelect().
-		Model((*entity)(nil)).
-		Where(
-			"fsym IN (?) AND tsym IN (?) AND at > NOW() - INTERVAL '?'",
-			bun.In(fromSymbols),
-			bun.In(toSymbolss),
-			ttl,
-		).
-		Scan(ctx, &entities)
+	err := query.Scan(ctx, &entities)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -124,3 +332,193 @@ func (postgres *postgres) Read(
 
 	return result, nil
 }
+
+func (postgres *postgres) ReadWatchlist(ctx context.Context) ([]Watch, error) {
+	watches := []watch{}
+
+	err := postgres.db.NewSelect().
+		Model((*watch)(nil)).
+		Scan(ctx, &watches)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		return nil, karma.Format(err, "postgres: select watchlist")
+	}
+
+	// converting implementations to interfaces
+	result := make([]Watch, len(watches))
+	for i, watch := range watches {
+		result[i] = Watch(watch)
+	}
+
+	return result, nil
+}
+
+func (postgres *postgres) WriteWatch(
+	ctx context.Context,
+	at time.Time,
+	fromSymbol string,
+	toSymbol string,
+	source string,
+) error {
+	_, err := postgres.db.NewInsert().Model(&watch{
+		At:   at,
+		Fsym: fromSymbol,
+		Tsym: toSymbol,
+		From: source,
+	}).On("CONFLICT ON CONSTRAINT watch_pair DO UPDATE").Exec(ctx)
+	if err != nil {
+		return karma.Format(err, "postgres: insert watch")
+	}
+
+	return nil
+}
+
+func (postgres *postgres) DeleteWatch(
+	ctx context.Context,
+	fromSymbol string,
+	toSymbol string,
+	source string,
+) error {
+	_, err := postgres.db.NewDelete().
+		Model((*watch)(nil)).
+		Where(
+			"fsym = ? AND tsym = ? AND source = ?",
+			fromSymbol,
+			toSymbol,
+			source,
+		).
+		Exec(ctx)
+	if err != nil {
+		return karma.Format(err, "postgres: delete watch")
+	}
+
+	return nil
+}
+
+func (postgres *postgres) DeleteWatchSeenBefore(
+	ctx context.Context,
+	fromSymbol string,
+	toSymbol string,
+	source string,
+	before time.Time,
+) error {
+	_, err := postgres.db.NewDelete().
+		Model((*watch)(nil)).
+		Where(
+			"fsym = ? AND tsym = ? AND source = ? AND at < ?",
+			fromSymbol,
+			toSymbol,
+			source,
+			before,
+		).
+		Exec(ctx)
+	if err != nil {
+		return karma.Format(err, "postgres: delete watch")
+	}
+
+	return nil
+}
+
+func (postgres *postgres) AcquireLease(
+	ctx context.Context,
+	name string,
+	holder string,
+	at time.Time,
+	ttl time.Duration,
+) (bool, error) {
+	// the lease is taken over only if it has expired, the row is not
+	// affected otherwise
+	result, err := postgres.db.ExecContext(
+		ctx,
+		`INSERT INTO leases (name, holder, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			holder = EXCLUDED.holder,
+			expires_at = EXCLUDED.expires_at
+		WHERE leases.expires_at < ? OR leases.holder = EXCLUDED.holder`,
+		name,
+		holder,
+		at.Add(ttl),
+		at,
+	)
+	if err != nil {
+		return false, karma.Format(err, "postgres: acquire lease")
+	}
+
+	acquired, err := result.RowsAffected()
+	if err != nil {
+		return false, karma.Format(err, "postgres: acquire lease: rows affected")
+	}
+
+	return acquired > 0, nil
+}
+
+func (postgres *postgres) ReleaseLease(
+	ctx context.Context,
+	name string,
+	holder string,
+) error {
+	_, err := postgres.db.NewDelete().
+		Model((*lease)(nil)).
+		Where("name = ? AND holder = ?", name, holder).
+		Exec(ctx)
+	if err != nil {
+		return karma.Format(err, "postgres: release lease")
+	}
+
+	return nil
+}
+
+func (postgres *postgres) WriteMember(
+	ctx context.Context,
+	name string,
+	at time.Time,
+	ttl time.Duration,
+) error {
+	_, err := postgres.db.NewInsert().Model(&member{
+		Name:      name,
+		ExpiresAt: at.Add(ttl),
+	}).On("CONFLICT (name) DO UPDATE").Exec(ctx)
+	if err != nil {
+		return karma.Format(err, "postgres: insert member")
+	}
+
+	return nil
+}
+
+func (postgres *postgres) ReadMembers(
+	ctx context.Context,
+	at time.Time,
+) ([]string, error) {
+	members := []string{}
+
+	err := postgres.db.NewSelect().
+		Model((*member)(nil)).
+		Column("name").
+		Where("expires_at >= ?", at).
+		Order("name").
+		Scan(ctx, &members)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		return nil, karma.Format(err, "postgres: select members")
+	}
+
+	return members, nil
+}
+
+func (postgres *postgres) DeleteMember(ctx context.Context, name string) error {
+	_, err := postgres.db.NewDelete().
+		Model((*member)(nil)).
+		Where("name = ?", name).
+		Exec(ctx)
+	if err != nil {
+		return karma.Format(err, "postgres: delete member")
+	}
+
+	return nil
+}
@@ -0,0 +1,480 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+
+	// registers the pure Go sqlite driver, so cgo is not required
+	_ "modernc.org/sqlite"
+)
+
+// We make sure sqlite implements the Cache interface.
+var _ Cache = (*sqlite)(nil)
+
+// sqlite keeps entries in a single file, it has the same schema as postgres
+// except the time is stored as unix nanoseconds and prices are stored as JSON
+// text.
+type sqlite struct {
+	path string
+
+	db *sql.DB
+}
+
+func (sqlite *sqlite) Boot() error {
+	dsn := fmt.Sprintf(
+		"file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)",
+		sqlite.path,
+	)
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return karma.Format(err, "sqlite: open %s", sqlite.path)
+	}
+
+	log.Debugf(nil, "sqlite: ensure table schema")
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS pricelist (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			at INTEGER NOT NULL,
+			fsym TEXT NOT NULL,
+			tsym TEXT NOT NULL,
+			raw TEXT NOT NULL,
+			display TEXT NOT NULL,
+			CONSTRAINT fsym_tsym UNIQUE (fsym, tsym)
+		);
+
+		CREATE TABLE IF NOT EXISTS watchlist (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			at INTEGER NOT NULL,
+			fsym TEXT NOT NULL,
+			tsym TEXT NOT NULL,
+			source TEXT NOT NULL,
+			CONSTRAINT watch_pair UNIQUE (fsym, tsym, source)
+		);
+
+		CREATE TABLE IF NOT EXISTS leases (
+			name TEXT PRIMARY KEY,
+			holder TEXT NOT NULL,
+			expires_at INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS members (
+			name TEXT PRIMARY KEY,
+			expires_at INTEGER NOT NULL
+		);
+	`)
+	if err != nil {
+		db.Close()
+
+		return karma.Format(err, "sqlite: create/ensure table")
+	}
+
+	sqlite.db = db
+
+	return nil
+}
+
+func (sqlite *sqlite) Close() {
+	err := sqlite.db.Close()
+	if err != nil {
+		log.Errorf(err, "sqlite: close")
+	}
+}
+
+func (sqlite *sqlite) Write(
+	ctx context.Context,
+	at time.Time,
+	fromSymbol string,
+	toSymbol string,
+	raw cryptocompare.RawPrice,
+	display cryptocompare.DisplayPrice,
+) error {
+	rawJSON, err := json.Marshal(raw)
+	if err != nil {
+		return karma.Format(err, "sqlite: encode raw price")
+	}
+
+	displayJSON, err := json.Marshal(display)
+	if err != nil {
+		return karma.Format(err, "sqlite: encode display price")
+	}
+
+	_, err = sqlite.db.ExecContext(
+		ctx,
+		`INSERT INTO pricelist (at, fsym, tsym, raw, display)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (fsym, tsym) DO UPDATE SET
+			at = excluded.at,
+			raw = excluded.raw,
+			display = excluded.display`,
+		at.UnixNano(),
+		fromSymbol,
+		toSymbol,
+		string(rawJSON),
+		string(displayJSON),
+	)
+	if err != nil {
+		return karma.Format(err, "sqlite: insert")
+	}
+
+	return nil
+}
+
+func (sqlite *sqlite) Delete(
+	ctx context.Context,
+	fromSymbol string,
+	toSymbol string,
+) (int, error) {
+	result, err := sqlite.db.ExecContext(
+		ctx,
+		`DELETE FROM pricelist
+		WHERE (? = '' OR fsym = ?) AND (? = '' OR tsym = ?)`,
+		fromSymbol,
+		fromSymbol,
+		toSymbol,
+		toSymbol,
+	)
+	if err != nil {
+		return 0, karma.Format(err, "sqlite: delete")
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, karma.Format(err, "sqlite: delete: rows affected")
+	}
+
+	return int(deleted), nil
+}
+
+func (sqlite *sqlite) Read(
+	ctx context.Context,
+	fromSymbols []string,
+	toSymbols []string,
+	ttl int,
+) ([]Entity, error) {
+	// the same condition as in postgres: at > NOW() - ttl
+	threshold := time.Now().Add(-time.Duration(ttl) * time.Second)
+
+	return sqlite.read(ctx, fromSymbols, toSymbols, threshold.UnixNano())
+}
+
+func (sqlite *sqlite) ReadStale(
+	ctx context.Context,
+	fromSymbols []string,
+	toSymbols []string,
+) ([]Entity, error) {
+	return sqlite.read(ctx, fromSymbols, toSymbols, math.MinInt64)
+}
+
+// read returns entities stored after the given threshold (unix nanoseconds).
+func (sqlite *sqlite) read(
+	ctx context.Context,
+	fromSymbols []string,
+	toSymbols []string,
+	threshold int64,
+) ([]Entity, error) {
+	if len(fromSymbols) == 0 || len(toSymbols) == 0 {
+		return nil, nil
+	}
+
+	args := []interface{}{}
+	for _, fsym := range fromSymbols {
+		args = append(args, fsym)
+	}
+
+	for _, tsym := range toSymbols {
+		args = append(args, tsym)
+	}
+
+	args = append(args, threshold)
+
+	rows, err := sqlite.db.QueryContext(
+		ctx,
+		fmt.Sprintf(
+			`SELECT id, at, fsym, tsym, raw, display FROM pricelist
+			WHERE fsym IN (%s) AND tsym IN (%s) AND at > ?`,
+			placeholders(len(fromSymbols)),
+			placeholders(len(toSymbols)),
+		),
+		args...,
+	)
+	if err != nil {
+		return nil, karma.Format(err, "sqlite: select")
+	}
+
+	defer rows.Close()
+
+	result := []Entity{}
+	for rows.Next() {
+		var (
+			entity  entity
+			at      int64
+			raw     string
+			display string
+		)
+
+		err := rows.Scan(
+			&entity.ID,
+			&at,
+			&entity.Fsym,
+			&entity.Tsym,
+			&raw,
+			&display,
+		)
+		if err != nil {
+			return nil, karma.Format(err, "sqlite: scan")
+		}
+
+		entity.At = time.Unix(0, at)
+
+		err = json.Unmarshal([]byte(raw), &entity.Raw)
+		if err != nil {
+			return nil, karma.Format(err, "sqlite: decode raw price")
+		}
+
+		err = json.Unmarshal([]byte(display), &entity.Display)
+		if err != nil {
+			return nil, karma.Format(err, "sqlite: decode display price")
+		}
+
+		result = append(result, Entity(entity))
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, karma.Format(err, "sqlite: select")
+	}
+
+	return result, nil
+}
+
+func (sqlite *sqlite) ReadWatchlist(ctx context.Context) ([]Watch, error) {
+	rows, err := sqlite.db.QueryContext(
+		ctx,
+		`SELECT id, at, fsym, tsym, source FROM watchlist`,
+	)
+	if err != nil {
+		return nil, karma.Format(err, "sqlite: select watchlist")
+	}
+
+	defer rows.Close()
+
+	result := []Watch{}
+	for rows.Next() {
+		var (
+			watch watch
+			at    int64
+		)
+
+		err := rows.Scan(&watch.ID, &at, &watch.Fsym, &watch.Tsym, &watch.From)
+		if err != nil {
+			return nil, karma.Format(err, "sqlite: scan watchlist")
+		}
+
+		watch.At = time.Unix(0, at)
+
+		result = append(result, Watch(watch))
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, karma.Format(err, "sqlite: select watchlist")
+	}
+
+	return result, nil
+}
+
+func (sqlite *sqlite) WriteWatch(
+	ctx context.Context,
+	at time.Time,
+	fromSymbol string,
+	toSymbol string,
+	source string,
+) error {
+	_, err := sqlite.db.ExecContext(
+		ctx,
+		`INSERT INTO watchlist (at, fsym, tsym, source)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (fsym, tsym, source) DO UPDATE SET at = excluded.at`,
+		at.UnixNano(),
+		fromSymbol,
+		toSymbol,
+		source,
+	)
+	if err != nil {
+		return karma.Format(err, "sqlite: insert watch")
+	}
+
+	return nil
+}
+
+func (sqlite *sqlite) DeleteWatch(
+	ctx context.Context,
+	fromSymbol string,
+	toSymbol string,
+	source string,
+) error {
+	_, err := sqlite.db.ExecContext(
+		ctx,
+		`DELETE FROM watchlist WHERE fsym = ? AND tsym = ? AND source = ?`,
+		fromSymbol,
+		toSymbol,
+		source,
+	)
+	if err != nil {
+		return karma.Format(err, "sqlite: delete watch")
+	}
+
+	return nil
+}
+
+func (sqlite *sqlite) DeleteWatchSeenBefore(
+	ctx context.Context,
+	fromSymbol string,
+	toSymbol string,
+	source string,
+	before time.Time,
+) error {
+	_, err := sqlite.db.ExecContext(
+		ctx,
+		`DELETE FROM watchlist
+		WHERE fsym = ? AND tsym = ? AND source = ? AND at < ?`,
+		fromSymbol,
+		toSymbol,
+		source,
+		before.UnixNano(),
+	)
+	if err != nil {
+		return karma.Format(err, "sqlite: delete watch")
+	}
+
+	return nil
+}
+
+func (sqlite *sqlite) AcquireLease(
+	ctx context.Context,
+	name string,
+	holder string,
+	at time.Time,
+	ttl time.Duration,
+) (bool, error) {
+	// the lease is taken over only if it has expired, the row is not
+	// affected otherwise
+	result, err := sqlite.db.ExecContext(
+		ctx,
+		`INSERT INTO leases (name, holder, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			holder = excluded.holder,
+			expires_at = excluded.expires_at
+		WHERE leases.expires_at < ? OR leases.holder = excluded.holder`,
+		name,
+		holder,
+		at.Add(ttl).UnixNano(),
+		at.UnixNano(),
+	)
+	if err != nil {
+		return false, karma.Format(err, "sqlite: acquire lease")
+	}
+
+	acquired, err := result.RowsAffected()
+	if err != nil {
+		return false, karma.Format(err, "sqlite: acquire lease: rows affected")
+	}
+
+	return acquired > 0, nil
+}
+
+func (sqlite *sqlite) ReleaseLease(
+	ctx context.Context,
+	name string,
+	holder string,
+) error {
+	_, err := sqlite.db.ExecContext(
+		ctx,
+		`DELETE FROM leases WHERE name = ? AND holder = ?`,
+		name,
+		holder,
+	)
+	if err != nil {
+		return karma.Format(err, "sqlite: release lease")
+	}
+
+	return nil
+}
+
+func (sqlite *sqlite) WriteMember(
+	ctx context.Context,
+	name string,
+	at time.Time,
+	ttl time.Duration,
+) error {
+	_, err := sqlite.db.ExecContext(
+		ctx,
+		`INSERT INTO members (name, expires_at) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET expires_at = excluded.expires_at`,
+		name,
+		at.Add(ttl).UnixNano(),
+	)
+	if err != nil {
+		return karma.Format(err, "sqlite: insert member")
+	}
+
+	return nil
+}
+
+func (sqlite *sqlite) ReadMembers(
+	ctx context.Context,
+	at time.Time,
+) ([]string, error) {
+	rows, err := sqlite.db.QueryContext(
+		ctx,
+		`SELECT name FROM members WHERE expires_at >= ? ORDER BY name`,
+		at.UnixNano(),
+	)
+	if err != nil {
+		return nil, karma.Format(err, "sqlite: select members")
+	}
+
+	defer rows.Close()
+
+	members := []string{}
+	for rows.Next() {
+		var name string
+
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, karma.Format(err, "sqlite: scan member")
+		}
+
+		members = append(members, name)
+	}
+
+	return members, rows.Err()
+}
+
+func (sqlite *sqlite) DeleteMember(ctx context.Context, name string) error {
+	_, err := sqlite.db.ExecContext(
+		ctx,
+		`DELETE FROM members WHERE name = ?`,
+		name,
+	)
+	if err != nil {
+		return karma.Format(err, "sqlite: delete member")
+	}
+
+	return nil
+}
+
+func placeholders(count int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", count), ",")
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// Watchlist is a persistent list of pairs refreshed by the updater on top of
+// the configured ones. A pair may be added by several sources, e.g. by the
+// observed demand or by an operator.
+type Watchlist interface {
+	// ReadWatchlist returns all pairs of the watchlist.
+	ReadWatchlist(ctx context.Context) ([]Watch, error)
+
+	// WriteWatch adds the pair to the watchlist on behalf of the given
+	// source or updates the time it was seen at.
+	WriteWatch(
+		ctx context.Context,
+		at time.Time,
+		fromSymbol string,
+		toSymbol string,
+		source string,
+	) error
+
+	// DeleteWatch removes the pair added by the given source from the
+	// watchlist.
+	DeleteWatch(
+		ctx context.Context,
+		fromSymbol string,
+		toSymbol string,
+		source string,
+	) error
+
+	// DeleteWatchSeenBefore removes the pair added by the given source from
+	// the watchlist if it was seen before the given time, so the pair seen
+	// since then by another instance sharing the watchlist is kept.
+	DeleteWatchSeenBefore(
+		ctx context.Context,
+		fromSymbol string,
+		toSymbol string,
+		source string,
+		before time.Time,
+	) error
+}
+
+// Watch describes a watchlist record.
+type Watch interface {
+	SeenAt() time.Time
+	FromSymbol() string
+	ToSymbol() string
+	Source() string
+}
+
+type watch struct {
+	bun.BaseModel `bun:"table:watchlist,alias:w"`
+
+	ID int64 `bun:",pk,autoincrement"`
+
+	At time.Time `bun:"at,type:timestamp"`
+
+	Fsym string `bun:"fsym,unique:watch_pair"`
+
+	Tsym string `bun:"tsym,unique:watch_pair"`
+
+	From string `bun:"source,unique:watch_pair"`
+}
+
+func (watch watch) SeenAt() time.Time {
+	return watch.At
+}
+
+func (watch watch) FromSymbol() string {
+	return watch.Fsym
+}
+
+func (watch watch) ToSymbol() string {
+	return watch.Tsym
+}
+
+func (watch watch) Source() string {
+	return watch.From
+}
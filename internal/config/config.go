@@ -1,7 +1,14 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cache"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
 	"github.com/kovetskiy/ko"
+	"github.com/reconquest/karma-go"
 )
 
 // Config is a configuration variables stored in environment variables on in a
@@ -20,13 +27,162 @@ type Config struct {
 
 	// CacheTTL is a duration of time (seconds) to treat cache entries as
 	// expired.
+	//
+	// If CacheHardTTL is greater, it's a soft TTL: expired entries are
+	// still served and refreshed in the background.
 	CacheTTL int `yaml:"cache_ttl" required:"true" env:"CACHE_TTL" default:"120"`
 
-	// Fsyms is a cryptocurrency symbols of interest.
-	Fsyms []string `yaml:"fsyms,inline" required:"true" env:"FSYMS" default:"[BTC]"`
+	// CacheHardTTL is a duration of time (seconds) expired entries are served
+	// for while being refreshed in the background. It takes effect only if
+	// entries fetched on demand are written to the cache.
+	CacheHardTTL int `yaml:"cache_hard_ttl" required:"false" env:"CACHE_HARD_TTL"`
+
+	// StaleIfError is a duration of time (seconds) an expired cache entry can
+	// still be served for if cryptocompare is not available.
+	StaleIfError int `yaml:"stale_if_error" required:"false" env:"STALE_IF_ERROR" default:"3600"`
+
+	// NegativeCacheTTL is a duration of time (seconds) to remember pairs which
+	// markets don't exist, such pairs are not requested from cryptocompare
+	// until then.
+	NegativeCacheTTL int `yaml:"negative_cache_ttl" required:"true" env:"NEGATIVE_CACHE_TTL" default:"300"`
+
+	// RequestTimeout is a duration of time (seconds) given to serve a single
+	// REST request or websocket query, including cache and upstream calls.
+	RequestTimeout int `yaml:"request_timeout" required:"true" env:"REQUEST_TIMEOUT" default:"15"`
+
+	// ReadOnlyWriteThrough enables writing prices fetched on demand into the
+	// cache storage in the read-only mode, such prices are always written in
+	// the read-write mode.
+	ReadOnlyWriteThrough bool `yaml:"read_only_write_through" required:"false" env:"READ_ONLY_WRITE_THROUGH"`
+
+	// Fsyms is a cryptocurrency symbols of interest, every combination of
+	// Fsyms and Tsyms is refreshed on top of Pairs.
+	Fsyms []string `yaml:"fsyms,inline" required:"false" env:"FSYMS"`
 
 	// Tsyms is a cryptocurrency symbols list to convert into.
-	Tsyms []string `yaml:"tsyms" required:"true" env:"TSYMS" default:"[USD]"`
+	Tsyms []string `yaml:"tsyms" required:"false" env:"TSYMS"`
+
+	// Pairs is a list of groups of exact pairs to refresh, every group may
+	// have its own update interval. The groups are read from the YAML file
+	// only.
+	Pairs []PairGroup `yaml:"pairs" required:"false"`
+
+	// TrackDemand enables refreshing pairs requested by users on top of the
+	// configured ones, the pairs are tracked until they are idle.
+	TrackDemand bool `yaml:"track_demand" required:"false" env:"TRACK_DEMAND"`
+
+	// TrackIdleTimeout is a duration of time (seconds) a pair is tracked for
+	// since it was requested last time.
+	TrackIdleTimeout int `yaml:"track_idle_timeout" required:"true" env:"TRACK_IDLE_TIMEOUT" default:"3600"`
+
+	// TrackMaxPairs is a maximum number of pairs tracked due to demand.
+	TrackMaxPairs int `yaml:"track_max_pairs" required:"true" env:"TRACK_MAX_PAIRS" default:"1000"`
+
+	// WebsocketPingInterval is a duration of time (seconds) between
+	// keepalive pings sent to websocket clients, no pings are sent if it's
+	// zero.
+	WebsocketPingInterval int `yaml:"websocket_ping_interval" required:"false" env:"WEBSOCKET_PING_INTERVAL" default:"30"`
+
+	// WebsocketIdleTimeout is a duration of time (seconds) a websocket
+	// client is disconnected after if it sends neither a message nor a pong
+	// or doesn't receive a message in time.
+	WebsocketIdleTimeout int `yaml:"websocket_idle_timeout" required:"false" env:"WEBSOCKET_IDLE_TIMEOUT" default:"60"`
+
+	// WebsocketMaxMessageSize is a maximum size (bytes) of a message
+	// received from a websocket client.
+	WebsocketMaxMessageSize int64 `yaml:"websocket_max_message_size" required:"false" env:"WEBSOCKET_MAX_MESSAGE_SIZE" default:"4096"`
+
+	// WebsocketQueueSize is a number of messages waiting to be sent to a
+	// websocket client, the client is disconnected once the queue is full.
+	WebsocketQueueSize int `yaml:"websocket_queue_size" required:"true" env:"WEBSOCKET_QUEUE_SIZE" default:"64"`
+
+	// WebsocketMaxConnections is a maximum number of open websocket
+	// connections, the rest are rejected.
+	WebsocketMaxConnections int `yaml:"websocket_max_connections" required:"false" env:"WEBSOCKET_MAX_CONNECTIONS" default:"10000"`
+
+	// UpstreamURL is a base address of the cryptocompare API, can be pointed at
+	// a mirror or a local stand-in.
+	UpstreamURL string `yaml:"upstream_url" required:"true" env:"UPSTREAM_URL" default:"https://min-api.cryptocompare.com"`
+
+	// UpstreamAPIKey is a cryptocompare API key, anonymous requests are made
+	// if it's not specified.
+	UpstreamAPIKey string `yaml:"upstream_api_key" required:"false" env:"UPSTREAM_API_KEY"`
+
+	// UpstreamAppName is a name of the application sent to cryptocompare as
+	// the extraParams param.
+	UpstreamAppName string `yaml:"upstream_app_name" required:"false" env:"UPSTREAM_APP_NAME" default:"cryptocompare-proxyd"`
+
+	// UpstreamTimeout is a duration of time (seconds) to wait for a response
+	// from cryptocompare.
+	UpstreamTimeout int `yaml:"upstream_timeout" required:"true" env:"UPSTREAM_TIMEOUT" default:"10"`
+
+	// UpstreamProxy is an address of an HTTP proxy to use for requests to
+	// cryptocompare, HTTP_PROXY/HTTPS_PROXY environment variables are used if
+	// it's not specified.
+	UpstreamProxy string `yaml:"upstream_proxy" required:"false" env:"UPSTREAM_PROXY"`
+
+	// UpstreamRetries is a number of extra attempts made when cryptocompare
+	// is rate-limiting or fails to respond.
+	UpstreamRetries int `yaml:"upstream_retries" required:"false" env:"UPSTREAM_RETRIES" default:"3"`
+
+	// UpstreamRateLimit is a number of calls per minute the program is
+	// allowed to make to cryptocompare, the budget is shared by the updater
+	// and on-demand requests.
+	UpstreamRateLimit int `yaml:"upstream_rate_limit" required:"true" env:"UPSTREAM_RATE_LIMIT" default:"300"`
+
+	// UpstreamBurst is a number of calls that can be made to cryptocompare
+	// at once without waiting for the budget to refill.
+	UpstreamBurst int `yaml:"upstream_burst" required:"true" env:"UPSTREAM_BURST" default:"20"`
+
+	// UpstreamReserve is a percentage of the burst that background refreshes
+	// never spend, so on-demand requests still have calls left.
+	UpstreamReserve int `yaml:"upstream_reserve" required:"false" env:"UPSTREAM_RESERVE" default:"25"`
+
+	// UpstreamConcurrency is a number of concurrent requests made to
+	// cryptocompare when a request is too large and has to be split into
+	// chunks or the requested pairs are grouped into several batches.
+	UpstreamConcurrency int `yaml:"upstream_concurrency" required:"true" env:"UPSTREAM_CONCURRENCY" default:"4"`
+
+	// AdminListenAddress is an address to listen for the admin API
+	// connections on, the admin API is disabled if it's not specified.
+	AdminListenAddress string `yaml:"admin_listen_address" required:"false" env:"ADMIN_LISTEN_ADDRESS"`
+
+	// AdminToken is a token the admin API requests should be authorized
+	// with.
+	AdminToken string `yaml:"admin_token" required:"false" env:"ADMIN_TOKEN"`
+
+	// LeaderElection enables electing a single instance running the updater
+	// among the instances sharing the cache storage, the rest only serve
+	// requests until the leader is gone.
+	LeaderElection bool `yaml:"leader_election" required:"false" env:"LEADER_ELECTION"`
+
+	// LeaderLeaseTTL is a duration of time (seconds) the leader is promoted
+	// for, another instance is promoted if the leader doesn't renew it in
+	// time.
+	LeaderLeaseTTL int `yaml:"leader_lease_ttl" required:"true" env:"LEADER_LEASE_TTL" default:"15"`
+
+	// Sharding enables splitting the pairs refreshed by the updater among
+	// the instances sharing the cache storage, every instance refreshes its
+	// own share.
+	Sharding bool `yaml:"sharding" required:"false" env:"SHARDING"`
+
+	// ShardMemberTTL is a duration of time (seconds) an instance is a member
+	// of the sharding for, the share of an instance that doesn't announce
+	// itself in time is taken over by the rest.
+	ShardMemberTTL int `yaml:"shard_member_ttl" required:"true" env:"SHARD_MEMBER_TTL" default:"15"`
+
+	// InstanceID is a name of the instance shown to others in leader
+	// election and sharding, a unique one is generated if it's not
+	// specified.
+	InstanceID string `yaml:"instance_id" required:"false" env:"INSTANCE_ID"`
+
+	// CacheBackend is a storage of the cache entries: postgres, sqlite or
+	// memory.
+	CacheBackend string `yaml:"cache_backend" required:"true" env:"CACHE_BACKEND" default:"postgres"`
+
+	// SQLitePath is a path to the database file used by the sqlite cache
+	// backend.
+	SQLitePath string `yaml:"sqlite_path" required:"false" env:"SQLITE_PATH" default:"cryptocompare-proxyd.db"`
 
 	// DatabaseAddress is an address of a database to connect to.
 	DatabaseAddress string `yaml:"database_address" required:"true" env:"DATABASE_ADDRESS" default:"localhost:5432"`
@@ -43,8 +199,35 @@ type Config struct {
 	DatabasePassword string `yaml:"database_password" required:"false" env:"DATABASE_PASSWORD" default:"cryptocompare-proxyd-dev"`
 }
 
+// PairGroup is a tier of pairs refreshed with the same interval and served
+// with the same TTL.
+type PairGroup struct {
+	// Name of the group, it's shown in the status.
+	Name string `yaml:"name" required:"false"`
+
+	// UpdateInterval is a duration of time (seconds) between updates of the
+	// pairs of the group, the global UpdateInterval is used if it's not
+	// specified.
+	UpdateInterval int `yaml:"update_interval" required:"false"`
+
+	// CacheTTL is a duration of time (seconds) to treat cache entries of the
+	// pairs of the group as expired, the global CacheTTL is used if it's not
+	// specified.
+	CacheTTL int `yaml:"cache_ttl" required:"false"`
+
+	// Pairs is a list of pairs in the FSYM/TSYM form.
+	Pairs []string `yaml:"pairs" required:"true"`
+}
+
+var (
+	defaultFsyms = []string{"BTC"}
+	defaultTsyms = []string{"USD"}
+)
+
 // Load read the given file or reads environment variables, returns instance of
 // Config with values from a file or environment variables.
+//
+// BTC to USD is refreshed if neither fsyms/tsyms nor pairs are specified.
 func Load(path string) (*Config, error) {
 	config := &Config{}
 	err := ko.Load(path, config, ko.RequireFile(false))
@@ -52,5 +235,101 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if (len(config.Fsyms) == 0) != (len(config.Tsyms) == 0) {
+		return nil, errors.New("fsyms and tsyms should be specified together")
+	}
+
+	if config.AdminListenAddress != "" && config.AdminToken == "" {
+		return nil, errors.New(
+			"admin_token should be specified along with admin_listen_address",
+		)
+	}
+
+	// a call can't be made without a token, and the reserve can't take the
+	// whole burst, otherwise the calls wait forever
+	if config.UpstreamBurst < 1 {
+		return nil, fmt.Errorf(
+			"upstream_burst should be at least 1, but got %d",
+			config.UpstreamBurst,
+		)
+	}
+
+	if config.UpstreamReserve < 0 || config.UpstreamReserve >= 100 {
+		return nil, fmt.Errorf(
+			"upstream_reserve should be in range [0, 100), but got %d",
+			config.UpstreamReserve,
+		)
+	}
+
+	if config.LeaderElection && config.Sharding {
+		return nil, errors.New(
+			"leader_election and sharding should not be enabled together",
+		)
+	}
+
+	if (config.LeaderElection || config.Sharding) &&
+		config.CacheBackend == cache.BackendMemory {
+		return nil, errors.New(
+			"leader_election and sharding require a cache_backend " +
+				"shared by instances",
+		)
+	}
+
+	if len(config.Fsyms) == 0 && len(config.Pairs) == 0 {
+		config.Fsyms = defaultFsyms
+		config.Tsyms = defaultTsyms
+	}
+
+	for i, group := range config.Pairs {
+		if group.UpdateInterval < 0 || group.CacheTTL < 0 {
+			return nil, fmt.Errorf(
+				"pairs[%d]: update_interval and cache_ttl "+
+					"should not be negative",
+				i,
+			)
+		}
+
+		for _, pair := range group.Pairs {
+			_, err := cryptocompare.ParsePair(pair)
+			if err != nil {
+				return nil, karma.Format(err, "pairs[%d]", i)
+			}
+		}
+	}
+
 	return config, nil
 }
+
+// RequiresRestart returns true if the given configuration differs from this
+// one in the settings which can't be reloaded without restart: the listen
+// address, the cache storage and the upstream settings.
+func (config *Config) RequiresRestart(other *Config) bool {
+	return !reflect.DeepEqual(config.static(), other.static())
+}
+
+// static returns a copy of the configuration without the settings which can
+// be reloaded.
+func (config *Config) static() Config {
+	static := *config
+
+	static.UpdateInterval = 0
+	static.CacheTTL = 0
+	static.CacheHardTTL = 0
+	static.StaleIfError = 0
+	static.NegativeCacheTTL = 0
+	static.RequestTimeout = 0
+	static.ReadOnlyWriteThrough = false
+	static.Fsyms = nil
+	static.Tsyms = nil
+	static.Pairs = nil
+	static.TrackDemand = false
+	static.TrackIdleTimeout = 0
+	static.TrackMaxPairs = 0
+	static.WebsocketPingInterval = 0
+	static.WebsocketIdleTimeout = 0
+	static.WebsocketMaxMessageSize = 0
+	static.WebsocketQueueSize = 0
+	static.WebsocketMaxConnections = 0
+
+	return static
+}
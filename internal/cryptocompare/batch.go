@@ -0,0 +1,113 @@
+package cryptocompare
+
+import (
+	"context"
+	"sync"
+)
+
+// Plan returns batches requesting the given pairs in as few upstream calls as
+// possible once the batches are split into chunks (see MaxFsymsLength and
+// MaxTsymsLength): it's either the exact Batches or a single batch of every
+// combination of the symbols of the pairs, the latter requests extra pairs
+// which are expected to be ignored by the caller.
+func Plan(pairs []Pair, maxFsyms int, maxTsyms int) []Batch {
+	exact := Batches(pairs)
+
+	fsyms, tsyms := Symbols(pairs)
+	product := []Batch{{Fsyms: fsyms, Tsyms: tsyms}}
+
+	if calls(product, maxFsyms, maxTsyms) < calls(exact, maxFsyms, maxTsyms) {
+		return product
+	}
+
+	return exact
+}
+
+// calls returns the number of upstream calls the given batches take.
+func calls(batches []Batch, maxFsyms int, maxTsyms int) int {
+	total := 0
+	for _, batch := range batches {
+		total += len(split(batch.Fsyms, maxFsyms)) *
+			len(split(batch.Tsyms, maxTsyms))
+	}
+
+	return total
+}
+
+// GetBatches requests prices of the given batches concurrently by at most
+// workers goroutines and merges them into a single list.
+//
+// If only some of the requests fail, the merged list of the rest is returned
+// together with *PartialError.
+func GetBatches(
+	ctx context.Context,
+	client Client,
+	batches []Batch,
+	workers int,
+) (*PriceList, error) {
+	if len(batches) == 1 {
+		return client.GetPriceList(ctx, batches[0].Fsyms, batches[0].Tsyms)
+	}
+
+	var (
+		result = &PriceList{}
+		failed = &PartialError{}
+		mutex  = sync.Mutex{}
+		queue  = make(chan Batch)
+		done   = sync.WaitGroup{}
+	)
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers && i < len(batches); i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+
+			for batch := range queue {
+				list, err := client.GetPriceList(
+					ctx,
+					batch.Fsyms,
+					batch.Tsyms,
+				)
+
+				mutex.Lock()
+				if list != nil {
+					result.Merge(list)
+				}
+
+				if partial, ok := err.(*PartialError); ok {
+					failed.Chunks = append(failed.Chunks, partial.Chunks...)
+				} else if err != nil {
+					failed.Chunks = append(failed.Chunks, ChunkError{
+						Fsyms: batch.Fsyms,
+						Tsyms: batch.Tsyms,
+						Err:   err,
+					})
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, batch := range batches {
+		queue <- batch
+	}
+
+	close(queue)
+
+	done.Wait()
+
+	switch {
+	case len(failed.Chunks) == 0:
+		return result, nil
+
+	case len(result.Raw) == 0:
+		return nil, failed
+
+	default:
+		return result, failed
+	}
+}
@@ -0,0 +1,101 @@
+package cryptocompare
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlan_RequestsEveryCombinationIfItTakesFewerCalls(t *testing.T) {
+	test := assert.New(t)
+
+	test.Equal(
+		[]Batch{
+			{
+				Fsyms: []string{"BTC", "ETH", "DOGE"},
+				Tsyms: []string{"USD", "EUR", "BTC"},
+			},
+		},
+		Plan(
+			[]Pair{
+				{Fsym: "BTC", Tsym: "USD"},
+				{Fsym: "ETH", Tsym: "EUR"},
+				{Fsym: "DOGE", Tsym: "BTC"},
+			},
+			MaxFsymsLength,
+			MaxTsymsLength,
+		),
+	)
+}
+
+func TestPlan_RequestsExactPairsIfItTakesFewerCalls(t *testing.T) {
+	test := assert.New(t)
+
+	// every combination takes 2x2 calls, while the exact pairs take 2 calls
+	test.Equal(
+		[]Batch{
+			{Fsyms: []string{"BTC"}, Tsyms: []string{"USD"}},
+			{Fsyms: []string{"ETH"}, Tsyms: []string{"EUR"}},
+		},
+		Plan(
+			[]Pair{
+				{Fsym: "BTC", Tsym: "USD"},
+				{Fsym: "ETH", Tsym: "EUR"},
+			},
+			3,
+			3,
+		),
+	)
+}
+
+// concurrentClient records the maximum number of calls made at once.
+type concurrentClient struct {
+	fakeClient
+
+	running int32
+	peak    int32
+}
+
+func (client *concurrentClient) GetPriceList(
+	ctx context.Context,
+	fsyms []string,
+	tsyms []string,
+) (*PriceList, error) {
+	running := atomic.AddInt32(&client.running, 1)
+	defer atomic.AddInt32(&client.running, -1)
+
+	for {
+		peak := atomic.LoadInt32(&client.peak)
+		if running <= peak ||
+			atomic.CompareAndSwapInt32(&client.peak, peak, running) {
+			break
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	return client.fakeClient.GetPriceList(ctx, fsyms, tsyms)
+}
+
+func TestGetBatches_LimitsConcurrentCalls(t *testing.T) {
+	test := assert.New(t)
+
+	client := &concurrentClient{}
+
+	batches := []Batch{}
+	for _, fsym := range []string{"BTC", "ETH", "XRP", "LTC", "DOGE", "ADA"} {
+		batches = append(batches, Batch{
+			Fsyms: []string{fsym},
+			Tsyms: []string{"USD"},
+		})
+	}
+
+	list, err := GetBatches(context.Background(), client, batches, 2)
+	test.NoError(err)
+	test.Len(list.Raw, len(batches))
+	test.Len(client.calls, len(batches))
+	test.LessOrEqual(atomic.LoadInt32(&client.peak), int32(2))
+}
@@ -0,0 +1,140 @@
+package cryptocompare
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrBudgetExhausted is returned to background callers when the remaining
+// budget is not enough to make a call without affecting on-demand requests.
+var ErrBudgetExhausted = errors.New("upstream call budget exhausted")
+
+type priorityKey struct{}
+
+// WithBackgroundPriority marks the calls made with the returned context as
+// background ones: such calls never wait for the budget and give up
+// immediately if the budget is running low, so the remaining calls are left
+// for on-demand requests.
+func WithBackgroundPriority(ctx context.Context) context.Context {
+	return context.WithValue(ctx, priorityKey{}, true)
+}
+
+func isBackground(ctx context.Context) bool {
+	background, _ := ctx.Value(priorityKey{}).(bool)
+	return background
+}
+
+// BudgetStatus is a snapshot of Budget.
+type BudgetStatus struct {
+	Remaining float64 `json:"remaining"`
+	Capacity  float64 `json:"capacity"`
+	Reserve   float64 `json:"reserve"`
+	PerMinute float64 `json:"per_minute"`
+}
+
+// Budget is a token bucket of upstream calls shared by all users of a client,
+// every call to the upstream (including retries) takes one token.
+type Budget struct {
+	mutex sync.Mutex
+
+	capacity float64
+	reserve  float64
+	rate     float64 // tokens per second
+
+	tokens    float64
+	updatedAt time.Time
+}
+
+// NewBudget creates a new budget that allows perMinute calls per minute with
+// bursts of up to burst calls. reserve is a percentage of burst which is
+// never spent by background calls.
+func NewBudget(perMinute int, burst int, reserve int) *Budget {
+	return &Budget{
+		capacity:  float64(burst),
+		reserve:   float64(burst) * float64(reserve) / 100,
+		rate:      float64(perMinute) / 60,
+		tokens:    float64(burst),
+		updatedAt: time.Now(),
+	}
+}
+
+// Take takes one token from the budget. Background calls (see
+// WithBackgroundPriority) fail with ErrBudgetExhausted if that would dig into
+// the reserve, other calls wait until a token is available or the context is
+// done.
+func (budget *Budget) Take(ctx context.Context) error {
+	background := isBackground(ctx)
+
+	for {
+		wait, err := budget.take(background)
+		if err != nil || wait == 0 {
+			return err
+		}
+
+		select {
+		case <-time.After(wait):
+			//
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (budget *Budget) take(background bool) (time.Duration, error) {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+
+	budget.refill()
+
+	if background {
+		if budget.tokens-1 < budget.reserve {
+			return 0, ErrBudgetExhausted
+		}
+
+		budget.tokens--
+
+		return 0, nil
+	}
+
+	if budget.tokens >= 1 {
+		budget.tokens--
+
+		return 0, nil
+	}
+
+	if budget.rate <= 0 {
+		return 0, ErrBudgetExhausted
+	}
+
+	missing := 1 - budget.tokens
+
+	return time.Duration(math.Ceil(missing / budget.rate * float64(time.Second))), nil
+}
+
+func (budget *Budget) refill() {
+	now := time.Now()
+
+	budget.tokens = math.Min(
+		budget.capacity,
+		budget.tokens+now.Sub(budget.updatedAt).Seconds()*budget.rate,
+	)
+	budget.updatedAt = now
+}
+
+// Status returns the current state of the budget.
+func (budget *Budget) Status() BudgetStatus {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+
+	budget.refill()
+
+	return BudgetStatus{
+		Remaining: math.Floor(budget.tokens),
+		Capacity:  budget.capacity,
+		Reserve:   budget.reserve,
+		PerMinute: budget.rate * 60,
+	}
+}
@@ -0,0 +1,44 @@
+package cryptocompare
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBudget_Take_BackgroundYieldsToReserve(t *testing.T) {
+	test := assert.New(t)
+
+	budget := NewBudget(0, 4, 50)
+
+	ctx := WithBackgroundPriority(context.Background())
+
+	test.NoError(budget.Take(ctx))
+	test.NoError(budget.Take(ctx))
+	test.Equal(ErrBudgetExhausted, budget.Take(ctx))
+
+	// the reserve is still available for foreground calls
+	test.NoError(budget.Take(context.Background()))
+	test.NoError(budget.Take(context.Background()))
+
+	test.EqualValues(0, budget.Status().Remaining)
+}
+
+func TestBudget_Take_ForegroundWaitsForRefill(t *testing.T) {
+	test := assert.New(t)
+
+	budget := NewBudget(600, 1, 0)
+
+	test.NoError(budget.Take(context.Background()))
+
+	startedAt := time.Now()
+	test.NoError(budget.Take(context.Background()))
+	test.True(time.Since(startedAt) >= 50*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	test.Equal(context.DeadlineExceeded, budget.Take(ctx))
+}
@@ -0,0 +1,210 @@
+package cryptocompare
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/reconquest/pkg/log"
+)
+
+const (
+	// MaxFsymsLength is a maximum length of the comma-separated fsyms param
+	// accepted by the pricemultifull endpoint.
+	MaxFsymsLength = 300
+
+	// MaxTsymsLength is a maximum length of the comma-separated tsyms param
+	// accepted by the pricemultifull endpoint.
+	MaxTsymsLength = 100
+)
+
+// We make sure chunked implements the Client interface.
+var _ Client = (*chunked)(nil)
+
+// ChunkError describes a failed request of a single chunk.
+type ChunkError struct {
+	Fsyms []string
+	Tsyms []string
+	Err   error
+}
+
+func (err ChunkError) Error() string {
+	return fmt.Sprintf(
+		"chunk fsyms=%s tsyms=%s: %s",
+		strings.Join(err.Fsyms, ","),
+		strings.Join(err.Tsyms, ","),
+		err.Err,
+	)
+}
+
+// PartialError is returned along with a non-nil PriceList when some of the
+// chunks of a request failed, the list contains prices of the rest chunks.
+type PartialError struct {
+	Chunks []ChunkError
+}
+
+func (err *PartialError) Error() string {
+	messages := make([]string, len(err.Chunks))
+	for i, chunk := range err.Chunks {
+		messages[i] = chunk.Error()
+	}
+
+	return fmt.Sprintf(
+		"%d chunk(s) failed: %s",
+		len(err.Chunks),
+		strings.Join(messages, "; "),
+	)
+}
+
+type chunked struct {
+	client         Client
+	maxFsymsLength int
+	maxTsymsLength int
+	workers        int
+}
+
+// NewChunked wraps the given client, so requests with fsyms/tsyms longer than
+// the given limits are split into several requests made concurrently by at
+// most workers goroutines. Results of the requests are merged into a single
+// PriceList.
+//
+// If only some of the requests fail, the merged list of the rest is returned
+// together with *PartialError.
+func NewChunked(
+	client Client,
+	maxFsymsLength int,
+	maxTsymsLength int,
+	workers int,
+) Client {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &chunked{
+		client:         client,
+		maxFsymsLength: maxFsymsLength,
+		maxTsymsLength: maxTsymsLength,
+		workers:        workers,
+	}
+}
+
+type chunk struct {
+	fsyms []string
+	tsyms []string
+}
+
+func (chunked *chunked) GetPriceList(
+	ctx context.Context,
+	fsyms []string,
+	tsyms []string,
+) (*PriceList, error) {
+	fsymsChunks := split(fsyms, chunked.maxFsymsLength)
+	tsymsChunks := split(tsyms, chunked.maxTsymsLength)
+
+	if len(fsymsChunks) <= 1 && len(tsymsChunks) <= 1 {
+		return chunked.client.GetPriceList(ctx, fsyms, tsyms)
+	}
+
+	chunks := []chunk{}
+	for _, fsyms := range fsymsChunks {
+		for _, tsyms := range tsymsChunks {
+			chunks = append(chunks, chunk{fsyms: fsyms, tsyms: tsyms})
+		}
+	}
+
+	log.Debugf(
+		nil,
+		"client: splitting request into %d chunks",
+		len(chunks),
+	)
+
+	var (
+		result = &PriceList{}
+		failed = &PartialError{}
+		mutex  = sync.Mutex{}
+		queue  = make(chan chunk)
+		done   = sync.WaitGroup{}
+	)
+
+	for i := 0; i < chunked.workers && i < len(chunks); i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+
+			for chunk := range queue {
+				list, err := chunked.client.GetPriceList(
+					ctx,
+					chunk.fsyms,
+					chunk.tsyms,
+				)
+
+				mutex.Lock()
+				if list != nil {
+					result.Merge(list)
+				}
+
+				if err != nil {
+					failed.Chunks = append(failed.Chunks, ChunkError{
+						Fsyms: chunk.fsyms,
+						Tsyms: chunk.tsyms,
+						Err:   err,
+					})
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, chunk := range chunks {
+		queue <- chunk
+	}
+
+	close(queue)
+
+	done.Wait()
+
+	switch {
+	case len(failed.Chunks) == 0:
+		return result, nil
+
+	case len(failed.Chunks) == len(chunks):
+		return nil, failed
+
+	default:
+		return result, failed
+	}
+}
+
+// split splits the given symbols into groups, so every group joined with
+// commas is not longer than the given length.
+func split(symbols []string, length int) [][]string {
+	groups := [][]string{}
+
+	group := []string{}
+	groupLength := 0
+	for _, symbol := range symbols {
+		symbolLength := len(symbol)
+		if len(group) > 0 {
+			// the comma
+			symbolLength++
+		}
+
+		if len(group) > 0 && groupLength+symbolLength > length {
+			groups = append(groups, group)
+
+			group = []string{}
+			groupLength = 0
+			symbolLength = len(symbol)
+		}
+
+		group = append(group, symbol)
+		groupLength += symbolLength
+	}
+
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+
+	return groups
+}
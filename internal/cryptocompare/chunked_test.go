@@ -0,0 +1,97 @@
+package cryptocompare
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClient struct {
+	mutex sync.Mutex
+	calls [][2][]string
+	fail  map[string]bool
+}
+
+func (client *fakeClient) GetPriceList(
+	ctx context.Context,
+	fsyms []string,
+	tsyms []string,
+) (*PriceList, error) {
+	client.mutex.Lock()
+	client.calls = append(client.calls, [2][]string{fsyms, tsyms})
+	client.mutex.Unlock()
+
+	list := &PriceList{}
+	for _, fsym := range fsyms {
+		if client.fail[fsym] {
+			return nil, errors.New("unable to get " + fsym)
+		}
+
+		list.Merge(&PriceList{
+			Raw: map[string]map[string]RawPrice{fsym: {}},
+		})
+
+		for _, tsym := range tsyms {
+			list.Raw[fsym][tsym] = RawPrice{Price: 1}
+		}
+	}
+
+	return list, nil
+}
+
+func TestSplit_RespectsLength(t *testing.T) {
+	test := assert.New(t)
+
+	test.Equal(
+		[][]string{{"BTC", "ETH"}, {"DOGE"}, {"LONGSYMBOL"}},
+		split([]string{"BTC", "ETH", "DOGE", "LONGSYMBOL"}, 7),
+	)
+
+	test.Equal(
+		[][]string{{"BTC", "ETH", "DOGE"}},
+		split([]string{"BTC", "ETH", "DOGE"}, 12),
+	)
+}
+
+func TestChunked_GetPriceList_MergesChunks(t *testing.T) {
+	test := assert.New(t)
+
+	upstream := &fakeClient{}
+	client := NewChunked(upstream, 7, 3, 2)
+
+	list, err := client.GetPriceList(
+		context.Background(),
+		[]string{"BTC", "ETH", "DOGE"},
+		[]string{"USD", "EUR"},
+	)
+	test.NoError(err)
+	test.Len(upstream.calls, 4)
+
+	test.Len(list.Raw, 3)
+	test.Len(list.Raw["DOGE"], 2)
+}
+
+func TestChunked_GetPriceList_ReportsFailedChunks(t *testing.T) {
+	test := assert.New(t)
+
+	upstream := &fakeClient{fail: map[string]bool{"DOGE": true}}
+	client := NewChunked(upstream, 7, 100, 2)
+
+	list, err := client.GetPriceList(
+		context.Background(),
+		[]string{"BTC", "ETH", "DOGE"},
+		[]string{"USD"},
+	)
+	test.NotNil(list)
+	test.Contains(list.Raw, "BTC")
+	test.NotContains(list.Raw, "DOGE")
+
+	partial, ok := err.(*PartialError)
+	if test.True(ok) {
+		test.Len(partial.Chunks, 1)
+		test.Equal([]string{"DOGE"}, partial.Chunks[0].Fsyms)
+	}
+}
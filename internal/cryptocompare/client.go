@@ -1,19 +1,28 @@
 package cryptocompare
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
 )
 
 const (
-	apiURI = "https://min-api.cryptocompare.com/data/pricemultifull"
+	// DefaultBaseURL is the address of the official cryptocompare API.
+	DefaultBaseURL = "https://min-api.cryptocompare.com"
+
+	priceMultiFullPath = "/data/pricemultifull"
+
+	backoffBase = 500 * time.Millisecond
+	backoffMax  = 10 * time.Second
 )
 
 type remoteResponse struct {
@@ -22,62 +31,208 @@ type remoteResponse struct {
 }
 
 // Client can talk to cryptocompare and return current prices.
+//
+// Implementations may return a non-nil PriceList together with *PartialError
+// if only some of the requested prices could not be fetched.
 type Client interface {
-	GetPriceList(fsyms []string, tsyms []string) (*PriceList, error)
+	GetPriceList(
+		ctx context.Context,
+		fsyms []string,
+		tsyms []string,
+	) (*PriceList, error)
 }
 
 type client struct {
 	version string
+	baseURL string
+	apiKey  string
+	appName string
 	http    *http.Client
+
+	budget  *Budget
+	retries int
+}
+
+// Options are the options of the client talking to cryptocompare.
+type Options struct {
+	// Version of the program sent in the User-Agent header.
+	Version string
+
+	// BaseURL allows to point the client at a mirror or a local stand-in of
+	// the cryptocompare API, DefaultBaseURL is used if it's not specified.
+	BaseURL string
+
+	// APIKey and AppName are optional and sent along with every request.
+	APIKey  string
+	AppName string
+
+	// Timeout (seconds) bounds every request, requests are not bounded if
+	// it's zero.
+	Timeout int
+
+	// Proxy is an optional address of an outbound HTTP proxy, the proxy from
+	// environment variables is used if it's not specified.
+	Proxy string
+
+	// Budget is optional and may be shared between several clients.
+	Budget *Budget
+
+	// Retries is a number of extra attempts made if the upstream is
+	// rate-limiting or fails.
+	Retries int
 }
 
 // New creates a new client to talk to cryptocompare.
-func New(version string) (Client, error) {
+func New(options Options) (Client, error) {
+	baseURL := options.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, karma.Format(err, "parse base url: %s", baseURL)
+	}
+
+	if base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf(
+			"base url should contain scheme and host, but got %q",
+			baseURL,
+		)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.Proxy != "" {
+		proxyURL, err := url.Parse(options.Proxy)
+		if err != nil {
+			return nil, karma.Format(err, "parse proxy url: %s", options.Proxy)
+		}
+
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
 	return &client{
-		http: &http.Client{},
+		version: options.Version,
+		baseURL: strings.TrimSuffix(base.String(), "/"),
+		apiKey:  options.APIKey,
+		appName: options.AppName,
+		http: &http.Client{
+			Transport: transport,
+			Timeout:   time.Duration(options.Timeout) * time.Second,
+		},
+		budget:  options.Budget,
+		retries: options.Retries,
 	}, nil
 }
 
 // GetPriceList makes a HTTP request and returns the current prices.
+//
+// Every attempt takes a call from the budget, rate-limited and failed
+// attempts are retried with an exponential backoff.
 func (client *client) GetPriceList(
+	ctx context.Context,
 	fsyms []string,
 	tsyms []string,
 ) (*PriceList, error) {
+	for attempt := 0; ; attempt++ {
+		if client.budget != nil {
+			err := client.budget.Take(ctx)
+			if err != nil {
+				return nil, karma.Format(err, "take upstream call budget")
+			}
+		}
+
+		list, retryable, err := client.getPriceList(ctx, fsyms, tsyms)
+		if err == nil {
+			return list, nil
+		}
+
+		if !retryable || attempt >= client.retries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		delay := backoff(attempt)
+
+		log.Warningf(
+			err,
+			"client: attempt %d of %d failed, retrying in %v",
+			attempt+1,
+			client.retries+1,
+			delay,
+		)
+
+		select {
+		case <-time.After(delay):
+			//
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// backoff returns a delay before the next attempt, it grows exponentially
+// and is randomized to avoid retrying in lockstep with other callers.
+func backoff(attempt int) time.Duration {
+	delay := backoffBase << attempt
+	if delay > backoffMax || delay <= 0 {
+		delay = backoffMax
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (client *client) getPriceList(
+	ctx context.Context,
+	fsyms []string,
+	tsyms []string,
+) (*PriceList, bool, error) {
 	query := url.Values{}
 	query.Add("fsyms", strings.Join(fsyms, ","))
 	query.Add("tsyms", strings.Join(tsyms, ","))
 
-	uri := apiURI + "?" + query.Encode()
+	if client.appName != "" {
+		query.Add("extraParams", client.appName)
+	}
+
+	uri := client.baseURL + priceMultiFullPath + "?" + query.Encode()
 
-	request, err := http.NewRequest("GET", uri, nil)
+	request, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
 	if err != nil {
-		return nil, karma.Format(err, "new request")
+		return nil, false, karma.Format(err, "new request")
 	}
 
 	request.Header.Set("User-Agent", "cryptocompare-proxyd/"+client.version)
 
+	// the key is sent in the header rather than in the api_key param, so it
+	// doesn't leak into the debug messages below.
+	if client.apiKey != "" {
+		request.Header.Set("Authorization", "Apikey "+client.apiKey)
+	}
+
 	log.Debugf(nil, "client: GET request to %s", uri)
 
 	response, err := client.http.Do(request)
 	if err != nil {
-		return nil, karma.Format(err, "http GET request")
+		// network errors and timeouts are worth retrying
+		return nil, true, karma.Format(err, "http GET request")
 	}
 
 	defer response.Body.Close()
 
 	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf(
-			"unexpected status code, expected: %v, but got %v",
-			http.StatusOK,
-			response.Status,
-		)
+		err := RemoteError{
+			StatusCode: response.StatusCode,
+			Message:    response.Status,
+		}
+
+		return nil, err.IsTemporary(), err
 	}
 
 	// we read the contents completely instead of streaming into json.Decoder
 	// because we are going to use the output in debug messages in case of error
 	contents, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return nil, karma.Format(err, "read response body")
+		return nil, true, karma.Format(err, "read response body")
 	}
 
 	var list PriceList
@@ -90,7 +245,7 @@ func (client *client) GetPriceList(
 			"unable to decode json response",
 		)
 
-		return nil, karma.Format(err, "decode json response")
+		return nil, false, karma.Format(err, "decode json response")
 	}
 
 	if len(list.Raw) == 0 && len(list.Display) == 0 {
@@ -102,11 +257,16 @@ func (client *client) GetPriceList(
 		if err == nil && remoteError.Response == "Error" {
 			// our case is when we don't have problems decoding the JSON, otherwise
 			// it would fail even in previous json.Unmarshal cases.
-			return nil, karma.
+			err := RemoteError{
+				StatusCode: response.StatusCode,
+				Message:    remoteError.Message,
+			}
+
+			return nil, err.IsTemporary(), karma.
 				Describe("contents", string(contents)).
-				Format(nil, "the remote server returned an error: %s", remoteError.Message)
+				Format(err, "the remote server returned an error")
 		}
 	}
 
-	return &list, nil
+	return &list, false, nil
 }
@@ -1,6 +1,9 @@
 package cryptocompare
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -9,14 +12,18 @@ import (
 func TestClient_GetPriceList_ReturnsValidData(t *testing.T) {
 	test := assert.New(t)
 
-	client, err := New("testing")
+	client, err := New(Options{Version: "testing", Timeout: 10})
 	if !test.NoError(err) {
 		test.FailNow("should be able to initialize an instance of client")
 	}
 
 	test.NotNil(client)
 
-	price, err := client.GetPriceList([]string{"BTC"}, []string{"USD", "EUR"})
+	price, err := client.GetPriceList(
+		context.Background(),
+		[]string{"BTC"},
+		[]string{"USD", "EUR"},
+	)
 	test.NoError(err)
 	test.NotNil(price)
 
@@ -39,16 +46,70 @@ func TestClient_GetPriceList_ReturnsValidData(t *testing.T) {
 func TestClient_GetPriceList_ReturnsError(t *testing.T) {
 	test := assert.New(t)
 
-	client, err := New("testing")
+	client, err := New(Options{Version: "testing", Timeout: 10})
 	if !test.NoError(err) {
 		test.FailNow("should be able to initialize an instance of client")
 	}
 
 	test.NotNil(client)
 
-	price, err := client.GetPriceList([]string{"blah"}, []string{"blah"})
+	price, err := client.GetPriceList(
+		context.Background(),
+		[]string{"blah"},
+		[]string{"blah"},
+	)
 	test.Nil(price)
 	test.Error(err)
 
 	test.Contains(err.Error(), "market does not exist ")
 }
+
+func TestClient_GetPriceList_SendsAPIKeyAndAppName(t *testing.T) {
+	test := assert.New(t)
+
+	var request *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(response http.ResponseWriter, received *http.Request) {
+			request = received
+
+			response.Write([]byte(`{
+				"RAW": {"BTC": {"USD": {"PRICE": 1}}},
+				"DISPLAY": {"BTC": {"USD": {"PRICE": "$ 1"}}}
+			}`))
+		},
+	))
+	defer upstream.Close()
+
+	client, err := New(Options{
+		Version: "testing",
+		BaseURL: upstream.URL,
+		APIKey:  "secret",
+		AppName: "proxy",
+		Timeout: 10,
+	})
+	if !test.NoError(err) {
+		return
+	}
+
+	price, err := client.GetPriceList(
+		context.Background(),
+		[]string{"BTC"},
+		[]string{"USD"},
+	)
+	test.NoError(err)
+	test.Equal(1.0, price.Raw["BTC"]["USD"].Price)
+
+	if test.NotNil(request) {
+		test.Equal(priceMultiFullPath, request.URL.Path)
+		test.Equal("Apikey secret", request.Header.Get("Authorization"))
+		test.Equal("cryptocompare-proxyd/testing", request.UserAgent())
+
+		query := request.URL.Query()
+		test.Equal("proxy", query.Get("extraParams"))
+		test.Equal("BTC", query.Get("fsyms"))
+		test.Equal("USD", query.Get("tsyms"))
+
+		// the key is not leaked into the logged url
+		test.Empty(query.Get("api_key"))
+	}
+}
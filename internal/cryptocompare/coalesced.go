@@ -0,0 +1,153 @@
+package cryptocompare
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/reconquest/karma-go"
+)
+
+// We make sure coalesced implements the Client interface.
+var _ Client = (*coalesced)(nil)
+
+type coalesced struct {
+	client Client
+
+	mutex sync.Mutex
+	calls map[string]*call
+}
+
+// call is an in-flight request shared by all callers asking for the same set
+// of fsyms/tsyms.
+type call struct {
+	done chan struct{}
+	list *PriceList
+	err  error
+
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// NewCoalesced wraps the given client, so concurrent requests of the same set
+// of fsyms/tsyms share a single upstream request and its result or error.
+//
+// The shared request is cancelled only when all of its callers are gone. The
+// returned PriceList is shared between the callers and must not be modified.
+func NewCoalesced(client Client) Client {
+	return &coalesced{
+		client: client,
+		calls:  map[string]*call{},
+	}
+}
+
+func (coalesced *coalesced) GetPriceList(
+	ctx context.Context,
+	fsyms []string,
+	tsyms []string,
+) (*PriceList, error) {
+	key := normalize(fsyms) + "|" + normalize(tsyms)
+
+	coalesced.mutex.Lock()
+	shared, ok := coalesced.calls[key]
+	if !ok {
+		shared = coalesced.start(ctx, key, fsyms, tsyms)
+	}
+
+	shared.waiters++
+	coalesced.mutex.Unlock()
+
+	select {
+	case <-shared.done:
+		// a background request yields to the budget reserve, but the caller
+		// may be allowed to spend it
+		if ok && !isBackground(ctx) &&
+			karma.Contains(shared.err, ErrBudgetExhausted) {
+			return coalesced.client.GetPriceList(ctx, fsyms, tsyms)
+		}
+
+		return shared.list, shared.err
+
+	case <-ctx.Done():
+		coalesced.mutex.Lock()
+		shared.waiters--
+		if shared.waiters == 0 {
+			shared.cancel()
+
+			// the next caller starts a new call instead of joining the
+			// cancelled one
+			coalesced.forget(key, shared)
+		}
+		coalesced.mutex.Unlock()
+
+		return nil, ctx.Err()
+	}
+}
+
+// start starts a new shared request, it's not bound to the context of the
+// caller, so the caller leaving doesn't affect the rest callers. The priority
+// of the caller is kept though.
+func (coalesced *coalesced) start(
+	ctx context.Context,
+	key string,
+	fsyms []string,
+	tsyms []string,
+) *call {
+	callCtx := context.Background()
+	if isBackground(ctx) {
+		callCtx = WithBackgroundPriority(callCtx)
+	}
+
+	callCtx, cancel := context.WithCancel(callCtx)
+
+	shared := &call{
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+
+	coalesced.calls[key] = shared
+
+	go func() {
+		defer cancel()
+
+		list, err := coalesced.client.GetPriceList(callCtx, fsyms, tsyms)
+
+		coalesced.mutex.Lock()
+		coalesced.forget(key, shared)
+		coalesced.mutex.Unlock()
+
+		shared.list = list
+		shared.err = err
+
+		close(shared.done)
+	}()
+
+	return shared
+}
+
+// forget removes the given call unless it's already replaced by a new one,
+// the mutex should be held.
+func (coalesced *coalesced) forget(key string, shared *call) {
+	if coalesced.calls[key] == shared {
+		delete(coalesced.calls, key)
+	}
+}
+
+// normalize returns sorted unique symbols joined with commas.
+func normalize(symbols []string) string {
+	unique := []string{}
+	seen := map[string]bool{}
+	for _, symbol := range symbols {
+		if seen[symbol] {
+			continue
+		}
+
+		seen[symbol] = true
+		unique = append(unique, symbol)
+	}
+
+	sort.Strings(unique)
+
+	return strings.Join(unique, ",")
+}
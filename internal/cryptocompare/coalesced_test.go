@@ -0,0 +1,173 @@
+package cryptocompare
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type blockingClient struct {
+	calls   int32
+	release chan struct{}
+
+	// linger delays returning of cancelled calls until it's closed if it's
+	// specified.
+	linger chan struct{}
+}
+
+func (client *blockingClient) GetPriceList(
+	ctx context.Context,
+	fsyms []string,
+	tsyms []string,
+) (*PriceList, error) {
+	atomic.AddInt32(&client.calls, 1)
+
+	select {
+	case <-client.release:
+		return &PriceList{}, nil
+	case <-ctx.Done():
+		if client.linger != nil {
+			<-client.linger
+		}
+
+		return nil, ctx.Err()
+	}
+}
+
+func TestCoalesced_GetPriceList_SharesConcurrentCalls(t *testing.T) {
+	test := assert.New(t)
+
+	upstream := &blockingClient{release: make(chan struct{})}
+	client := NewCoalesced(upstream)
+
+	results := make(chan *PriceList, 3)
+	workers := sync.WaitGroup{}
+	for _, fsyms := range [][]string{
+		{"BTC", "ETH"},
+		{"ETH", "BTC"},
+		{"BTC", "ETH", "BTC"},
+	} {
+		workers.Add(1)
+		go func(fsyms []string) {
+			defer workers.Done()
+
+			list, err := client.GetPriceList(
+				context.Background(),
+				fsyms,
+				[]string{"USD"},
+			)
+			test.NoError(err)
+
+			results <- list
+		}(fsyms)
+	}
+
+	// wait until all callers joined the same call
+	joined := test.Eventually(func() bool {
+		shared := client.(*coalesced)
+		shared.mutex.Lock()
+		defer shared.mutex.Unlock()
+
+		return len(shared.calls) == 1 && waitersOf(shared) == 3
+	}, 5*time.Second, time.Millisecond)
+	if !joined {
+		close(upstream.release)
+		return
+	}
+
+	close(upstream.release)
+	workers.Wait()
+
+	test.EqualValues(1, atomic.LoadInt32(&upstream.calls))
+
+	first := <-results
+	test.Equal(first, <-results)
+	test.Equal(first, <-results)
+}
+
+func TestCoalesced_GetPriceList_CancelsWhenAllCallersLeave(t *testing.T) {
+	test := assert.New(t)
+
+	upstream := &blockingClient{release: make(chan struct{})}
+	client := NewCoalesced(upstream)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := client.GetPriceList(ctx, []string{"BTC"}, []string{"USD"})
+	test.Equal(context.Canceled, err)
+
+	// the shared call is cancelled, so it's gone without being released
+	test.Eventually(func() bool {
+		shared := client.(*coalesced)
+		shared.mutex.Lock()
+		defer shared.mutex.Unlock()
+
+		return len(shared.calls) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestCoalesced_GetPriceList_StartsNewCallOnceCancelled(t *testing.T) {
+	test := assert.New(t)
+
+	upstream := &blockingClient{
+		release: make(chan struct{}),
+		linger:  make(chan struct{}),
+	}
+	defer close(upstream.linger)
+
+	client := NewCoalesced(upstream)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := client.GetPriceList(ctx, []string{"BTC"}, []string{"USD"})
+	test.Equal(context.Canceled, err)
+
+	// the cancelled call is still in flight, but the fresh caller doesn't
+	// join it
+	type result struct {
+		list *PriceList
+		err  error
+	}
+
+	results := make(chan result, 1)
+	go func() {
+		list, err := client.GetPriceList(
+			context.Background(),
+			[]string{"BTC"},
+			[]string{"USD"},
+		)
+
+		results <- result{list: list, err: err}
+	}()
+
+	test.Eventually(func() bool {
+		return atomic.LoadInt32(&upstream.calls) == 2
+	}, 5*time.Second, time.Millisecond)
+
+	close(upstream.release)
+
+	select {
+	case fresh := <-results:
+		test.NoError(fresh.err)
+		test.NotNil(fresh.list)
+	case <-time.After(5 * time.Second):
+		test.Fail("the fresh call is not finished")
+	}
+}
+
+// waitersOf returns a total number of the callers of the in-flight calls,
+// the mutex should be held.
+func waitersOf(coalesced *coalesced) int {
+	waiters := 0
+	for _, call := range coalesced.calls {
+		waiters += call.waiters
+	}
+
+	return waiters
+}
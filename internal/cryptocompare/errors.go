@@ -0,0 +1,60 @@
+package cryptocompare
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/reconquest/karma-go"
+)
+
+// RemoteError is an error reported by the cryptocompare service either by an
+// unexpected HTTP status or by an error response.
+type RemoteError struct {
+	StatusCode int
+	Message    string
+}
+
+func (err RemoteError) Error() string {
+	if err.StatusCode != http.StatusOK {
+		return fmt.Sprintf(
+			"unexpected status code, expected: %v, but got %v",
+			http.StatusOK,
+			err.Message,
+		)
+	}
+
+	return err.Message
+}
+
+// IsRateLimited returns true if the remote server refused to serve the
+// request because one of the rate limits has been reached.
+func (err RemoteError) IsRateLimited() bool {
+	return err.StatusCode == http.StatusTooManyRequests ||
+		strings.Contains(strings.ToLower(err.Message), "rate limit")
+}
+
+// IsMarketNotExist returns true if the remote server doesn't know any of the
+// requested pairs.
+func (err RemoteError) IsMarketNotExist() bool {
+	return strings.Contains(
+		strings.ToLower(err.Message),
+		"market does not exist",
+	)
+}
+
+// IsTemporary returns true if the same request may succeed later.
+func (err RemoteError) IsTemporary() bool {
+	return err.IsRateLimited() || err.StatusCode >= 500
+}
+
+// IsMarketNotExist returns true if the given error (or any of its reasons) is
+// a remote error reporting that the requested markets don't exist.
+func IsMarketNotExist(err error) bool {
+	var remote RemoteError
+	if karma.Find(err, &remote) {
+		return remote.IsMarketNotExist()
+	}
+
+	return false
+}
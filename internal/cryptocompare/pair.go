@@ -0,0 +1,129 @@
+package cryptocompare
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Pair is a pair of a cryptocurrency symbol of interest and a symbol to
+// convert it into.
+type Pair struct {
+	Fsym string `json:"fsym"`
+	Tsym string `json:"tsym"`
+}
+
+func (pair Pair) String() string {
+	return pair.Fsym + "/" + pair.Tsym
+}
+
+// ParsePair parses a pair in the FSYM/TSYM form.
+func ParsePair(value string) (Pair, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Pair{}, fmt.Errorf(
+			"pair should be in the FSYM/TSYM form, but got %q",
+			value,
+		)
+	}
+
+	return Pair{Fsym: parts[0], Tsym: parts[1]}, nil
+}
+
+// Symbols returns unique fsyms and tsyms of the given pairs.
+func Symbols(pairs []Pair) ([]string, []string) {
+	fsyms := []string{}
+	tsyms := []string{}
+
+	seenFsyms := map[string]bool{}
+	seenTsyms := map[string]bool{}
+	for _, pair := range pairs {
+		if !seenFsyms[pair.Fsym] {
+			seenFsyms[pair.Fsym] = true
+			fsyms = append(fsyms, pair.Fsym)
+		}
+
+		if !seenTsyms[pair.Tsym] {
+			seenTsyms[pair.Tsym] = true
+			tsyms = append(tsyms, pair.Tsym)
+		}
+	}
+
+	return fsyms, tsyms
+}
+
+// Batch is a request of prices of every combination of Fsyms and Tsyms.
+type Batch struct {
+	Fsyms []string
+	Tsyms []string
+}
+
+// Batches groups the given pairs into batches, so every batch requests the
+// given pairs only and the number of batches is kept small: pairs are grouped
+// either by fsyms having the same set of tsyms or by tsyms having the same set
+// of fsyms, whichever gives fewer batches.
+func Batches(pairs []Pair) []Batch {
+	byFsym := batches(pairs, false)
+	byTsym := batches(pairs, true)
+
+	if len(byTsym) < len(byFsym) {
+		return byTsym
+	}
+
+	return byFsym
+}
+
+func batches(pairs []Pair, transpose bool) []Batch {
+	// keys are the symbols the pairs are grouped by, values are the other
+	// symbols of the pairs
+	keys := []string{}
+	values := map[string][]string{}
+	seen := map[Pair]bool{}
+	for _, pair := range pairs {
+		if seen[pair] {
+			continue
+		}
+
+		seen[pair] = true
+
+		key, value := pair.Fsym, pair.Tsym
+		if transpose {
+			key, value = value, key
+		}
+
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+
+		values[key] = append(values[key], value)
+	}
+
+	result := []Batch{}
+	index := map[string]int{}
+	for _, key := range keys {
+		sort.Strings(values[key])
+
+		signature := strings.Join(values[key], ",")
+
+		i, ok := index[signature]
+		if !ok {
+			i = len(result)
+			index[signature] = i
+
+			result = append(result, Batch{})
+			if transpose {
+				result[i].Fsyms = values[key]
+			} else {
+				result[i].Tsyms = values[key]
+			}
+		}
+
+		if transpose {
+			result[i].Tsyms = append(result[i].Tsyms, key)
+		} else {
+			result[i].Fsyms = append(result[i].Fsyms, key)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,49 @@
+package cryptocompare
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatches_GroupsPairsWithSameSymbols(t *testing.T) {
+	test := assert.New(t)
+
+	test.Equal(
+		[]Batch{
+			{Fsyms: []string{"BTC", "ETH"}, Tsyms: []string{"EUR", "USD"}},
+			{Fsyms: []string{"DOGE"}, Tsyms: []string{"BTC"}},
+		},
+		Batches([]Pair{
+			{Fsym: "BTC", Tsym: "USD"},
+			{Fsym: "BTC", Tsym: "EUR"},
+			{Fsym: "ETH", Tsym: "EUR"},
+			{Fsym: "ETH", Tsym: "USD"},
+			{Fsym: "DOGE", Tsym: "BTC"},
+		}),
+	)
+
+	test.Equal(
+		[]Batch{
+			{Fsyms: []string{"BTC", "ETH", "DOGE"}, Tsyms: []string{"USD"}},
+		},
+		Batches([]Pair{
+			{Fsym: "BTC", Tsym: "USD"},
+			{Fsym: "ETH", Tsym: "USD"},
+			{Fsym: "DOGE", Tsym: "USD"},
+		}),
+	)
+}
+
+func TestParsePair(t *testing.T) {
+	test := assert.New(t)
+
+	pair, err := ParsePair("BTC/USD")
+	test.NoError(err)
+	test.Equal(Pair{Fsym: "BTC", Tsym: "USD"}, pair)
+
+	for _, value := range []string{"", "BTC", "BTC/", "/USD", "BTC/USD/EUR"} {
+		_, err := ParsePair(value)
+		test.Error(err, value)
+	}
+}
@@ -36,3 +36,57 @@ type DisplayPrice struct {
 	Supply          string `json:"SUPPLY"`
 	Mktcap          string `json:"MKTCAP"`
 }
+
+// Set puts the prices of the given pair into the list.
+func (list *PriceList) Set(pair Pair, raw RawPrice, display DisplayPrice) {
+	if list.Raw == nil {
+		list.Raw = map[string]map[string]RawPrice{}
+	}
+
+	if list.Display == nil {
+		list.Display = map[string]map[string]DisplayPrice{}
+	}
+
+	if _, ok := list.Raw[pair.Fsym]; !ok {
+		list.Raw[pair.Fsym] = map[string]RawPrice{}
+	}
+
+	if _, ok := list.Display[pair.Fsym]; !ok {
+		list.Display[pair.Fsym] = map[string]DisplayPrice{}
+	}
+
+	list.Raw[pair.Fsym][pair.Tsym] = raw
+	list.Display[pair.Fsym][pair.Tsym] = display
+}
+
+// Merge copies the prices of the other list into the list, the prices of the
+// other list take precedence.
+func (list *PriceList) Merge(other *PriceList) {
+	if list.Raw == nil {
+		list.Raw = map[string]map[string]RawPrice{}
+	}
+
+	if list.Display == nil {
+		list.Display = map[string]map[string]DisplayPrice{}
+	}
+
+	for fsym, prices := range other.Raw {
+		if _, ok := list.Raw[fsym]; !ok {
+			list.Raw[fsym] = map[string]RawPrice{}
+		}
+
+		for tsym, price := range prices {
+			list.Raw[fsym][tsym] = price
+		}
+	}
+
+	for fsym, prices := range other.Display {
+		if _, ok := list.Display[fsym]; !ok {
+			list.Display[fsym] = map[string]DisplayPrice{}
+		}
+
+		for tsym, price := range prices {
+			list.Display[fsym][tsym] = price
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+)
+
+const (
+	// SourceUpdater is a source of the prices written by the updater.
+	SourceUpdater = "updater"
+
+	// SourceServer is a source of the prices received on demand and written
+	// by the server.
+	SourceServer = "server"
+
+	// SourceRemote is a source of the prices written by other instances
+	// sharing the cache storage.
+	SourceRemote = "remote"
+
+	// SourceUnknown is a source of the prices written without a source
+	// given, see WithSource.
+	SourceUnknown = "unknown"
+)
+
+// Event describes a price written into the cache storage.
+type Event struct {
+	Pair cryptocompare.Pair
+
+	// Old is the previously written raw price, nil if it's not known.
+	Old *cryptocompare.RawPrice
+
+	New     cryptocompare.RawPrice
+	Display cryptocompare.DisplayPrice
+
+	// At is a time the price was received at.
+	At time.Time
+
+	// Source is a component that has written the price, see Source*.
+	Source string
+}
+
+// Changed returns true if the written price differs from the previous one or
+// the previous one is not known.
+func (event Event) Changed() bool {
+	return event.Old == nil || *event.Old != event.New
+}
+
+type sourceKey struct{}
+
+// WithSource returns a context telling the writes made with it are made by
+// the given source.
+func WithSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// source returns the source given by WithSource.
+func source(ctx context.Context) string {
+	if source, ok := ctx.Value(sourceKey{}).(string); ok {
+		return source
+	}
+
+	return SourceUnknown
+}
+
+// DropPolicy decides which event is dropped when a subscriber's buffer is
+// full.
+type DropPolicy int
+
+const (
+	// DropNewest drops the published event, the buffered ones are kept.
+	DropNewest DropPolicy = iota
+
+	// DropOldest drops the oldest buffered event to make room for the
+	// published one.
+	DropOldest
+)
+
+// Status describes the bus.
+type Status struct {
+	Subscribers int   `json:"subscribers"`
+	Published   int64 `json:"published"`
+	Dropped     int64 `json:"dropped"`
+}
+
+// Bus delivers the published events to every subscriber. Publishing never
+// blocks: every subscriber has a buffer of its own and the events not
+// fitting into it are dropped according to the subscriber's policy.
+type Bus struct {
+	subscriptions map[*Subscription]bool
+	published     int64
+	dropped       int64
+	mutex         sync.RWMutex
+}
+
+// NewBus returns a bus without subscribers.
+func NewBus() *Bus {
+	return &Bus{
+		subscriptions: map[*Subscription]bool{},
+	}
+}
+
+// Subscribe returns a subscription receiving the events the given filter
+// accepts, every event is accepted if the filter is nil. The size is a
+// number of events buffered for the subscriber.
+func (bus *Bus) Subscribe(
+	size int,
+	policy DropPolicy,
+	filter func(Event) bool,
+) *Subscription {
+	subscription := &Subscription{
+		bus:    bus,
+		events: make(chan Event, size),
+		policy: policy,
+		filter: filter,
+	}
+
+	bus.mutex.Lock()
+	bus.subscriptions[subscription] = true
+	bus.mutex.Unlock()
+
+	return subscription
+}
+
+// Publish delivers the given event to the subscribers.
+func (bus *Bus) Publish(event Event) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	bus.published++
+
+	for subscription := range bus.subscriptions {
+		if !subscription.deliver(event) {
+			bus.dropped++
+		}
+	}
+}
+
+// Status returns the numbers of the subscribers and the published and
+// dropped events.
+func (bus *Bus) Status() Status {
+	bus.mutex.RLock()
+	defer bus.mutex.RUnlock()
+
+	return Status{
+		Subscribers: len(bus.subscriptions),
+		Published:   bus.published,
+		Dropped:     bus.dropped,
+	}
+}
+
+// Subscription receives the events published to the bus.
+type Subscription struct {
+	bus    *Bus
+	events chan Event
+	policy DropPolicy
+	filter func(Event) bool
+
+	// dropped is a number of events dropped since the buffer was full, it's
+	// guarded by the bus mutex.
+	dropped int64
+	closed  bool
+}
+
+// Events returns the channel of the received events, it's closed once the
+// subscription is closed.
+func (subscription *Subscription) Events() <-chan Event {
+	return subscription.events
+}
+
+// Dropped returns a number of events dropped since the buffer was full.
+func (subscription *Subscription) Dropped() int64 {
+	subscription.bus.mutex.RLock()
+	defer subscription.bus.mutex.RUnlock()
+
+	return subscription.dropped
+}
+
+// Close stops receiving events.
+func (subscription *Subscription) Close() {
+	subscription.bus.mutex.Lock()
+	defer subscription.bus.mutex.Unlock()
+
+	if subscription.closed {
+		return
+	}
+
+	subscription.closed = true
+
+	delete(subscription.bus.subscriptions, subscription)
+	close(subscription.events)
+}
+
+// deliver buffers the given event if it's accepted by the filter, returns
+// false if an event has been dropped. It's expected to be called with the
+// bus mutex locked.
+func (subscription *Subscription) deliver(event Event) bool {
+	if subscription.filter != nil && !subscription.filter(event) {
+		return true
+	}
+
+	select {
+	case subscription.events <- event:
+		return true
+	default:
+	}
+
+	subscription.dropped++
+
+	if subscription.policy == DropNewest {
+		return false
+	}
+
+	// the receiver may have drained the buffer in the meantime, so the
+	// oldest event is not necessarily dropped
+	select {
+	case <-subscription.events:
+	default:
+	}
+
+	select {
+	case subscription.events <- event:
+	default:
+	}
+
+	return false
+}
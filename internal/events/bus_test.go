@@ -0,0 +1,204 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cache"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestEvent(price float64) Event {
+	return Event{
+		Pair: cryptocompare.Pair{Fsym: "BTC", Tsym: "USD"},
+		New:  cryptocompare.RawPrice{Price: price},
+	}
+}
+
+func TestBus_Publish_DropsEventsAccordingToPolicy(t *testing.T) {
+	test := assert.New(t)
+
+	bus := NewBus()
+
+	newest := bus.Subscribe(2, DropNewest, nil)
+	oldest := bus.Subscribe(2, DropOldest, nil)
+	filtered := bus.Subscribe(2, DropNewest, func(event Event) bool {
+		return event.New.Price > 2
+	})
+
+	for price := 1.0; price <= 3; price++ {
+		bus.Publish(newTestEvent(price))
+	}
+
+	test.Equal(1.0, (<-newest.Events()).New.Price)
+	test.Equal(2.0, (<-newest.Events()).New.Price)
+	test.Equal(int64(1), newest.Dropped())
+
+	test.Equal(2.0, (<-oldest.Events()).New.Price)
+	test.Equal(3.0, (<-oldest.Events()).New.Price)
+	test.Equal(int64(1), oldest.Dropped())
+
+	test.Equal(3.0, (<-filtered.Events()).New.Price)
+	test.Equal(int64(0), filtered.Dropped())
+
+	test.Equal(Status{Subscribers: 3, Published: 3, Dropped: 2}, bus.Status())
+
+	filtered.Close()
+	filtered.Close()
+
+	_, ok := <-filtered.Events()
+	test.False(ok)
+	test.Equal(2, bus.Status().Subscribers)
+}
+
+func TestCache_Write_PublishesWrittenPrices(t *testing.T) {
+	test := assert.New(t)
+
+	storage, err := cache.New(cache.BackendMemory, "", "", "", "", "")
+	test.NoError(err)
+	test.NoError(storage.Boot())
+
+	bus := NewBus()
+	subscription := bus.Subscribe(10, DropNewest, nil)
+
+	publishing := NewCache(storage, bus)
+
+	write := func(ctx context.Context, price float64) {
+		err := publishing.Write(
+			ctx,
+			time.Now(),
+			"BTC",
+			"USD",
+			cryptocompare.RawPrice{Price: price},
+			cryptocompare.DisplayPrice{},
+		)
+		test.NoError(err)
+	}
+
+	write(WithSource(context.Background(), SourceUpdater), 1)
+	write(context.Background(), 1)
+	write(context.Background(), 2)
+
+	first := <-subscription.Events()
+	test.Nil(first.Old)
+	test.True(first.Changed())
+	test.Equal(SourceUpdater, first.Source)
+
+	second := <-subscription.Events()
+	test.False(second.Changed())
+	test.Equal(SourceUnknown, second.Source)
+
+	third := <-subscription.Events()
+	test.True(third.Changed())
+	test.Equal(1.0, third.Old.Price)
+	test.Equal(2.0, third.New.Price)
+
+	// the deleted price is not compared with
+	_, err = publishing.Delete(context.Background(), "BTC", "")
+	test.NoError(err)
+
+	write(context.Background(), 2)
+	test.Nil((<-subscription.Events()).Old)
+}
+
+// fakeNotifier notifies about the given notifications once, then pretends
+// the connection has been lost and re-established.
+type fakeNotifier struct {
+	cache.Cache
+
+	notifications []cache.Notification
+}
+
+func (notifier *fakeNotifier) Listen(
+	ctx context.Context,
+	notify func(cache.Notification),
+	resume func(lostAt time.Time),
+) {
+	for _, notification := range notifier.notifications {
+		notify(notification)
+	}
+
+	resume(time.Now())
+}
+
+func (notifier *fakeNotifier) ReadSince(
+	ctx context.Context,
+	at time.Time,
+) ([]cache.Entity, error) {
+	return notifier.ReadStale(
+		ctx,
+		[]string{"BTC", "ETH", "DOGE"},
+		[]string{"USD"},
+	)
+}
+
+func TestCache_Listen_PublishesPricesOfOtherInstances(t *testing.T) {
+	test := assert.New(t)
+
+	storage, err := cache.New(cache.BackendMemory, "", "", "", "", "")
+	test.NoError(err)
+	test.NoError(storage.Boot())
+
+	bus := NewBus()
+	subscription := bus.Subscribe(10, DropNewest, nil)
+
+	notifier := &fakeNotifier{Cache: storage}
+	publishing := NewCache(notifier, bus)
+
+	now := time.Now()
+
+	write := func(storage cache.Cache, fsym string) {
+		err := storage.Write(
+			context.Background(),
+			now,
+			fsym,
+			"USD",
+			cryptocompare.RawPrice{Price: 1},
+			cryptocompare.DisplayPrice{},
+		)
+		test.NoError(err)
+	}
+
+	// written by this instance and by others, DOGE is missed by the
+	// notifications
+	write(publishing, "BTC")
+	write(storage, "ETH")
+	write(storage, "DOGE")
+
+	// XRP is not read from the storage since the notification carries it
+	notifier.notifications = []cache.Notification{
+		{Fsym: "BTC", Tsym: "USD", At: now},
+		{Fsym: "ETH", Tsym: "USD", At: now},
+		{
+			Fsym:    "XRP",
+			Tsym:    "USD",
+			At:      now,
+			Raw:     &cryptocompare.RawPrice{Price: 5},
+			Display: &cryptocompare.DisplayPrice{Price: "5"},
+		},
+	}
+
+	publishing.Listen(context.Background())
+	subscription.Close()
+
+	sources := map[string]string{}
+	prices := map[string]float64{}
+	for event := range subscription.Events() {
+		sources[event.Pair.Fsym] = event.Source
+		prices[event.Pair.Fsym] = event.New.Price
+	}
+
+	test.Equal(
+		map[string]string{
+			"BTC":  SourceUnknown,
+			"ETH":  SourceRemote,
+			"DOGE": SourceRemote,
+			"XRP":  SourceRemote,
+		},
+		sources,
+	)
+	test.Equal(5.0, prices["XRP"])
+	test.Equal(int64(4), bus.Status().Published)
+}
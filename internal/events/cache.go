@@ -0,0 +1,254 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cache"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/reconquest/pkg/log"
+)
+
+const (
+	// catchUpMargin is a duration of time the prices written before the
+	// notifications were lost are caught up for, a price is written at the
+	// time it was requested at, so it's a bit older than the write.
+	catchUpMargin = time.Minute
+)
+
+// We make sure Cache implements the Cache interface.
+var _ cache.Cache = (*Cache)(nil)
+
+// Cache publishes an event to the bus on every successful write, the
+// previous prices are remembered in the process memory. The prices written
+// by other instances are published as well if the storage notifies about
+// them, see Listen.
+type Cache struct {
+	cache.Cache
+
+	bus *Bus
+
+	prices map[cryptocompare.Pair]price
+	mutex  sync.Mutex
+}
+
+// price is the last known price of a pair.
+type price struct {
+	raw cryptocompare.RawPrice
+	at  time.Time
+}
+
+// NewCache returns the given cache publishing the written prices to the
+// given bus, the source of a write is given by WithSource.
+func NewCache(storage cache.Cache, bus *Bus) *Cache {
+	return &Cache{
+		Cache:  storage,
+		bus:    bus,
+		prices: map[cryptocompare.Pair]price{},
+	}
+}
+
+func (storage *Cache) Write(
+	ctx context.Context,
+	at time.Time,
+	fromSymbol string,
+	toSymbol string,
+	raw cryptocompare.RawPrice,
+	display cryptocompare.DisplayPrice,
+) error {
+	err := storage.Cache.Write(ctx, at, fromSymbol, toSymbol, raw, display)
+	if err != nil {
+		return err
+	}
+
+	storage.publish(
+		cryptocompare.Pair{Fsym: fromSymbol, Tsym: toSymbol},
+		at,
+		raw,
+		display,
+		source(ctx),
+	)
+
+	return nil
+}
+
+func (storage *Cache) Delete(
+	ctx context.Context,
+	fromSymbol string,
+	toSymbol string,
+) (int, error) {
+	deleted, err := storage.Cache.Delete(ctx, fromSymbol, toSymbol)
+	if err != nil {
+		return deleted, err
+	}
+
+	// the prices written later are not compared with the deleted ones
+	storage.mutex.Lock()
+	for pair := range storage.prices {
+		if fromSymbol != "" && pair.Fsym != fromSymbol {
+			continue
+		}
+
+		if toSymbol != "" && pair.Tsym != toSymbol {
+			continue
+		}
+
+		delete(storage.prices, pair)
+	}
+	storage.mutex.Unlock()
+
+	return deleted, nil
+}
+
+// Listen publishes the prices written by other instances until the given
+// context is cancelled, the prices missed while the storage was not
+// available are caught up by reading the storage. It returns right away if
+// the storage doesn't notify about the written prices.
+func (storage *Cache) Listen(ctx context.Context) {
+	notifier, ok := storage.Cache.(cache.Notifier)
+	if !ok {
+		log.Debugf(nil, "events: the cache storage doesn't notify about writes")
+		return
+	}
+
+	log.Infof(nil, "events: listening for the prices written by other instances")
+
+	notifier.Listen(
+		ctx,
+		func(notification cache.Notification) {
+			storage.receive(ctx, notification)
+		},
+		func(lostAt time.Time) {
+			storage.catchUp(ctx, notifier, lostAt)
+		},
+	)
+}
+
+// receive publishes the price of the given notification unless it's already
+// known, e.g. it has been written by this instance. The price is read from the
+// storage if the notification doesn't carry it.
+func (storage *Cache) receive(
+	ctx context.Context,
+	notification cache.Notification,
+) {
+	pair := cryptocompare.Pair{
+		Fsym: notification.Fsym,
+		Tsym: notification.Tsym,
+	}
+
+	if !storage.outdated(pair, notification.At) {
+		return
+	}
+
+	if notification.Raw != nil && notification.Display != nil {
+		storage.publish(
+			pair,
+			notification.At,
+			*notification.Raw,
+			*notification.Display,
+			SourceRemote,
+		)
+
+		return
+	}
+
+	// the price didn't fit the notification
+	entities, err := storage.Cache.ReadStale(
+		ctx,
+		[]string{pair.Fsym},
+		[]string{pair.Tsym},
+	)
+	if err != nil {
+		log.Errorf(err, "events: unable to read the notified price of %s", pair)
+		return
+	}
+
+	for _, entity := range entities {
+		storage.publishEntity(entity)
+	}
+}
+
+// catchUp publishes the prices written since the given time.
+func (storage *Cache) catchUp(
+	ctx context.Context,
+	notifier cache.Notifier,
+	lostAt time.Time,
+) {
+	entities, err := notifier.ReadSince(ctx, lostAt.Add(-catchUpMargin))
+	if err != nil {
+		log.Errorf(err, "events: unable to catch up the missed prices")
+		return
+	}
+
+	log.Infof(
+		nil,
+		"events: caught up %d price(s) written since %s",
+		len(entities),
+		lostAt.Format(time.RFC3339),
+	)
+
+	for _, entity := range entities {
+		storage.publishEntity(entity)
+	}
+}
+
+// outdated returns true if the known price of the pair is older than the
+// given time.
+func (storage *Cache) outdated(pair cryptocompare.Pair, at time.Time) bool {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	known, ok := storage.prices[pair]
+
+	return !ok || at.After(known.at)
+}
+
+// publishEntity publishes the price of the given entity written by another
+// instance unless a newer one is already known.
+func (storage *Cache) publishEntity(entity cache.Entity) {
+	storage.publish(
+		cryptocompare.Pair{
+			Fsym: entity.FromSymbol(),
+			Tsym: entity.ToSymbol(),
+		},
+		entity.StoredAt(),
+		entity.RawPrice(),
+		entity.DisplayPrice(),
+		SourceRemote,
+	)
+}
+
+// publish remembers the given price and publishes it along with the previous
+// one. The price written by another instance is ignored if a newer one is
+// already known.
+func (storage *Cache) publish(
+	pair cryptocompare.Pair,
+	at time.Time,
+	raw cryptocompare.RawPrice,
+	display cryptocompare.DisplayPrice,
+	source string,
+) {
+	event := Event{
+		Pair:    pair,
+		New:     raw,
+		Display: display,
+		At:      at,
+		Source:  source,
+	}
+
+	storage.mutex.Lock()
+	if old, ok := storage.prices[pair]; ok {
+		if source == SourceRemote && !at.After(old.at) {
+			storage.mutex.Unlock()
+			return
+		}
+
+		event.Old = &old.raw
+	}
+
+	storage.prices[pair] = price{raw: raw, at: at}
+	storage.mutex.Unlock()
+
+	storage.bus.Publish(event)
+}
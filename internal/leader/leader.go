@@ -0,0 +1,270 @@
+package leader
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cache"
+	"github.com/reconquest/pkg/log"
+)
+
+const (
+	// RoleLeader is a role of the instance holding the lease.
+	RoleLeader = "leader"
+
+	// RoleFollower is a role of the instances waiting for the lease.
+	RoleFollower = "follower"
+
+	// renewFactor is a number of attempts to renew the lease made within its
+	// TTL, so a single failed attempt doesn't cost the leadership.
+	renewFactor = 3
+)
+
+// Status describes the role of the instance.
+type Status struct {
+	Role      string     `json:"role"`
+	Holder    string     `json:"holder"`
+	Lease     string     `json:"lease"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Elector competes with other instances for a lease stored in the cache
+// storage, the instance holding the lease is the leader. The leader renews
+// the lease periodically, another instance is promoted once the lease
+// expires.
+type Elector struct {
+	lease  cache.Lease
+	name   string
+	holder string
+	ttl    time.Duration
+
+	// onChange is called with true once the instance becomes the leader
+	// and with false once it steps down.
+	onChange func(leading bool)
+
+	leading   bool
+	expiresAt time.Time
+	mutex     sync.Mutex
+
+	// electing is held during an attempt to acquire the lease, so the lease
+	// is not acquired again once it's released by Close.
+	electing sync.Mutex
+
+	context context.Context
+	cancel  context.CancelFunc
+}
+
+// New instance of Elector competing for the lease of the given name on behalf
+// of the given holder, a random holder is used if it's empty. The ttl is a
+// duration of time (seconds) the lease is held for without renewal.
+func New(
+	lease cache.Lease,
+	name string,
+	holder string,
+	ttl int,
+	onChange func(leading bool),
+) (*Elector, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("lease ttl should be positive, but got %d", ttl)
+	}
+
+	if holder == "" {
+		var err error
+
+		holder, err = NewHolder()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Elector{
+		lease:    lease,
+		name:     name,
+		holder:   holder,
+		ttl:      time.Duration(ttl) * time.Second,
+		onChange: onChange,
+		context:  ctx,
+		cancel:   cancel,
+	}, nil
+}
+
+// NewHolder returns a holder unique to the process: the hostname, the pid and
+// a random suffix, so restarted processes are distinguished.
+func NewHolder() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	suffix := make([]byte, 4)
+
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(
+		"%s-%d-%s",
+		hostname,
+		os.Getpid(),
+		hex.EncodeToString(suffix),
+	), nil
+}
+
+// Serve acquires and renews the lease until the elector is closed.
+func (elector *Elector) Serve() {
+	log.Infof(
+		nil,
+		"leader: competing for the lease %q as %s",
+		elector.name,
+		elector.holder,
+	)
+
+	for {
+		elector.elect()
+
+		select {
+		case <-time.After(elector.ttl / renewFactor):
+			//
+		case <-elector.context.Done():
+			return
+		}
+	}
+}
+
+// elect makes a single attempt to acquire or renew the lease.
+func (elector *Elector) elect() {
+	elector.electing.Lock()
+	defer elector.electing.Unlock()
+
+	if elector.context.Err() != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(
+		elector.context,
+		elector.ttl/renewFactor,
+	)
+	defer cancel()
+
+	now := time.Now()
+
+	acquired, err := elector.lease.AcquireLease(
+		ctx,
+		elector.name,
+		elector.holder,
+		now,
+		elector.ttl,
+	)
+	if err != nil {
+		if elector.context.Err() != nil {
+			return
+		}
+
+		log.Errorf(err, "leader: unable to acquire the lease %q", elector.name)
+
+		// the leader stays the leader until its lease expires, nobody else
+		// can acquire it until then anyway
+		elector.mutex.Lock()
+		expired := elector.leading && !now.Before(elector.expiresAt)
+		elector.mutex.Unlock()
+
+		if expired {
+			elector.change(false, time.Time{})
+		}
+
+		return
+	}
+
+	if acquired {
+		elector.change(true, now.Add(elector.ttl))
+	} else {
+		elector.change(false, time.Time{})
+	}
+}
+
+// change records the role and tells about it if it has changed.
+func (elector *Elector) change(leading bool, expiresAt time.Time) {
+	elector.mutex.Lock()
+	changed := elector.leading != leading
+	elector.leading = leading
+	elector.expiresAt = expiresAt
+	elector.mutex.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if leading {
+		log.Infof(nil, "leader: this instance is the %s now", RoleLeader)
+	} else {
+		log.Infof(nil, "leader: this instance is a %s now", RoleFollower)
+	}
+
+	if elector.onChange != nil {
+		elector.onChange(leading)
+	}
+}
+
+// Leading returns true if the instance is the leader.
+func (elector *Elector) Leading() bool {
+	elector.mutex.Lock()
+	defer elector.mutex.Unlock()
+
+	return elector.leading
+}
+
+// Status returns the role of the instance.
+func (elector *Elector) Status() Status {
+	elector.mutex.Lock()
+	defer elector.mutex.Unlock()
+
+	status := Status{
+		Role:   RoleFollower,
+		Holder: elector.holder,
+		Lease:  elector.name,
+	}
+
+	if elector.leading {
+		expiresAt := elector.expiresAt
+
+		status.Role = RoleLeader
+		status.ExpiresAt = &expiresAt
+	}
+
+	return status
+}
+
+// Close stops competing for the lease and releases it if it's held, so
+// another instance is promoted without waiting for the lease to expire.
+func (elector *Elector) Close() {
+	elector.cancel()
+
+	elector.electing.Lock()
+	defer elector.electing.Unlock()
+
+	if !elector.Leading() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		elector.ttl/renewFactor,
+	)
+	defer cancel()
+
+	err := elector.lease.ReleaseLease(ctx, elector.name, elector.holder)
+	if err != nil {
+		log.Errorf(err, "leader: unable to release the lease %q", elector.name)
+		return
+	}
+
+	elector.change(false, time.Time{})
+}
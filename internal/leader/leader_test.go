@@ -0,0 +1,42 @@
+package leader
+
+import (
+	"testing"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestElector_elect_PromotesSingleInstance(t *testing.T) {
+	test := assert.New(t)
+
+	storage, err := cache.New(cache.BackendMemory, "", "", "", "", "")
+	test.NoError(err)
+	test.NoError(storage.Boot())
+
+	changes := []bool{}
+
+	first, err := New(storage, "updater", "first", 60, func(leading bool) {
+		changes = append(changes, leading)
+	})
+	test.NoError(err)
+
+	second, err := New(storage, "updater", "second", 60, nil)
+	test.NoError(err)
+
+	first.elect()
+	second.elect()
+
+	test.True(first.Leading())
+	test.False(second.Leading())
+	test.Equal(RoleLeader, first.Status().Role)
+	test.Equal(RoleFollower, second.Status().Role)
+
+	// the lease is released on close, so the other instance is promoted
+	first.Close()
+	second.elect()
+
+	test.False(first.Leading())
+	test.True(second.Leading())
+	test.Equal([]bool{true, false}, changes)
+}
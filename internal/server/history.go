@@ -0,0 +1,173 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/events"
+	"github.com/reconquest/pkg/log"
+)
+
+const (
+	// historySize is a number of the recent changes kept for the stream
+	// clients reconnecting with the id of the last received event.
+	historySize = 4096
+
+	// historyQueueSize is a number of changes waiting to be added to the
+	// history, the oldest are dropped if the queue is full.
+	historyQueueSize = 1024
+)
+
+// historyEvent is a change of a price numbered in the order of publishing.
+type historyEvent struct {
+	id    uint64
+	event events.Event
+}
+
+// history is a ring buffer of the recent changes of prices, every change has
+// an id growing with every change. The ids are prefixed with the epoch of the
+// history, so the ids of the previous runs of the program are not mistaken
+// for the current ones.
+type history struct {
+	epoch string
+
+	ring []historyEvent
+	last uint64
+
+	// lost is the id of the first change after the changes that were lost,
+	// the changes after the older ids are incomplete.
+	lost uint64
+
+	// appended is closed once a change is appended, see wait.
+	appended chan struct{}
+	mutex    sync.Mutex
+}
+
+func newHistory(size int) *history {
+	return &history{
+		epoch:    strconv.FormatInt(time.Now().UnixNano(), 36),
+		ring:     make([]historyEvent, size),
+		appended: make(chan struct{}),
+	}
+}
+
+// append adds the given change to the history.
+func (history *history) append(event events.Event) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	history.last++
+	history.ring[history.last%uint64(len(history.ring))] = historyEvent{
+		id:    history.last,
+		event: event,
+	}
+
+	close(history.appended)
+	history.appended = make(chan struct{})
+}
+
+// lose marks the changes after the last one as lost, they have been dropped
+// before being appended.
+func (history *history) lose() {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	history.lost = history.last + 1
+}
+
+// cursor returns the id of the last change.
+func (history *history) cursor() uint64 {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	return history.last
+}
+
+// since returns the changes made after the change of the given id, false if
+// some of them are not kept anymore, are lost or the id is unknown.
+func (history *history) since(cursor uint64) ([]historyEvent, bool) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	if cursor > history.last || cursor < history.lost ||
+		history.last-cursor > uint64(len(history.ring)) {
+		return nil, false
+	}
+
+	result := []historyEvent{}
+	for id := cursor + 1; id <= history.last; id++ {
+		result = append(result, history.ring[id%uint64(len(history.ring))])
+	}
+
+	return result, true
+}
+
+// wait returns a channel closed once the next change is appended.
+func (history *history) wait() <-chan struct{} {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	return history.appended
+}
+
+// formatID returns the id of a stream event.
+func (history *history) formatID(cursor uint64) string {
+	return fmt.Sprintf("%s-%d", history.epoch, cursor)
+}
+
+// parseID returns the cursor of the given id of a stream event, false if it
+// isn't an id of this history.
+func (history *history) parseID(id string) (uint64, bool) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 || parts[0] != history.epoch {
+		return 0, false
+	}
+
+	cursor, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return cursor, true
+}
+
+// serveHistory adds the changes published to the bus to the history until
+// the server is closed.
+func (server *Server) serveHistory() {
+	if server.bus == nil {
+		return
+	}
+
+	subscription := server.bus.Subscribe(
+		historyQueueSize,
+		events.DropOldest,
+		events.Event.Changed,
+	)
+	defer subscription.Close()
+
+	var dropped int64
+	for {
+		select {
+		case event := <-subscription.Events():
+			// the dropped changes were published before the ones still
+			// queued, so the streams behind them are sent the snapshot
+			if current := subscription.Dropped(); current > dropped {
+				log.Warningf(
+					nil,
+					"history: %d change(s) dropped, the queue is full",
+					current-dropped,
+				)
+
+				dropped = current
+				server.history.lose()
+			}
+
+			server.history.append(event)
+		case <-server.context.Done():
+			return
+		}
+	}
+}
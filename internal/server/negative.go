@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/reconquest/karma-go"
+)
+
+const (
+	reasonMarketNotExist = "market does not exist"
+)
+
+// negativeCache remembers pairs which markets don't exist, so they are not
+// requested from the upstream over and over again.
+type negativeCache struct {
+	ttl time.Duration
+
+	mutex   sync.Mutex
+	entries map[cryptocompare.Pair]negativeEntry
+}
+
+type negativeEntry struct {
+	reason    string
+	expiresAt time.Time
+}
+
+func newNegativeCache(ttl int) *negativeCache {
+	return &negativeCache{
+		ttl:     time.Duration(ttl) * time.Second,
+		entries: map[cryptocompare.Pair]negativeEntry{},
+	}
+}
+
+// setTTL changes the TTL of the pairs remembered from now on.
+func (negative *negativeCache) setTTL(ttl int) {
+	negative.mutex.Lock()
+	defer negative.mutex.Unlock()
+
+	negative.ttl = time.Duration(ttl) * time.Second
+}
+
+// get returns the reason the given pair is known to be missing.
+func (negative *negativeCache) get(pair cryptocompare.Pair) (string, bool) {
+	negative.mutex.Lock()
+	defer negative.mutex.Unlock()
+
+	entry, ok := negative.entries[pair]
+	if !ok {
+		return "", false
+	}
+
+	if time.Now().After(entry.expiresAt) {
+		delete(negative.entries, pair)
+
+		return "", false
+	}
+
+	return entry.reason, true
+}
+
+// learn remembers the given pairs requested from the upstream which are
+// missing in the received list because their markets don't exist. A pair is
+// treated so if the upstream reported so or if it's just missing in a
+// successful response. Returns the reasons of the remembered pairs.
+func (negative *negativeCache) learn(
+	pairs []cryptocompare.Pair,
+	list *cryptocompare.PriceList,
+	err error,
+) map[cryptocompare.Pair]string {
+	learned := map[cryptocompare.Pair]string{}
+	for _, pair := range pairs {
+		if list != nil &&
+			hasRawPrice(list, pair.Fsym, pair.Tsym) &&
+			hasDisplayPrice(list, pair.Fsym, pair.Tsym) {
+			continue
+		}
+
+		reason := failureOf(pair, err)
+		switch {
+		case reason == nil:
+			learned[pair] = reasonMarketNotExist
+
+		case cryptocompare.IsMarketNotExist(reason):
+			var remote cryptocompare.RemoteError
+			if karma.Find(reason, &remote) {
+				learned[pair] = remote.Message
+			}
+		}
+	}
+
+	if len(learned) == 0 {
+		return learned
+	}
+
+	negative.mutex.Lock()
+	defer negative.mutex.Unlock()
+
+	now := time.Now()
+
+	// the pairs are learned rarely, so it's a good time to get rid of the
+	// expired entries
+	for pair, entry := range negative.entries {
+		if now.After(entry.expiresAt) {
+			delete(negative.entries, pair)
+		}
+	}
+
+	for pair, reason := range learned {
+		negative.entries[pair] = negativeEntry{
+			reason:    reason,
+			expiresAt: now.Add(negative.ttl),
+		}
+	}
+
+	return learned
+}
+
+// isolate requests one by one the given pairs which markets are reported
+// not to exist by a failed request of several pairs: such an error doesn't
+// tell which of the pairs are absent, so the valid ones would be remembered
+// as absent too. Returns the given list and error with the results of the
+// single requests merged in.
+func (server *Server) isolate(
+	ctx context.Context,
+	pairs []cryptocompare.Pair,
+	list *cryptocompare.PriceList,
+	err error,
+) (*cryptocompare.PriceList, error) {
+	suspects := []cryptocompare.Pair{}
+	for _, pair := range pairs {
+		if list != nil &&
+			hasRawPrice(list, pair.Fsym, pair.Tsym) &&
+			hasDisplayPrice(list, pair.Fsym, pair.Tsym) {
+			continue
+		}
+
+		if cryptocompare.IsMarketNotExist(failureOf(pair, err)) {
+			suspects = append(suspects, pair)
+		}
+	}
+
+	// a single suspect is the only pair its failed request was made for
+	if len(suspects) < 2 {
+		return list, err
+	}
+
+	batches := make([]cryptocompare.Batch, len(suspects))
+	for i, pair := range suspects {
+		batches[i] = cryptocompare.Batch{
+			Fsyms: []string{pair.Fsym},
+			Tsyms: []string{pair.Tsym},
+		}
+	}
+
+	isolated, isolatedErr := cryptocompare.GetBatches(
+		ctx,
+		server.client,
+		batches,
+		server.concurrency,
+	)
+
+	if isolated != nil {
+		if list == nil {
+			list = &cryptocompare.PriceList{}
+		}
+
+		list.Merge(isolated)
+	}
+
+	// the failures of the suspects are replaced with the failures of the
+	// single requests, the rest failures are kept as is
+	failed := &cryptocompare.PartialError{}
+	if partial, ok := err.(*cryptocompare.PartialError); ok {
+		for _, chunk := range partial.Chunks {
+			if !cryptocompare.IsMarketNotExist(chunk.Err) {
+				failed.Chunks = append(failed.Chunks, chunk)
+			}
+		}
+	}
+
+	if partial, ok := isolatedErr.(*cryptocompare.PartialError); ok {
+		failed.Chunks = append(failed.Chunks, partial.Chunks...)
+	}
+
+	switch {
+	case len(failed.Chunks) == 0:
+		return list, nil
+
+	case list == nil || len(list.Raw) == 0:
+		return nil, failed
+
+	default:
+		return list, failed
+	}
+}
+
+// failureOf returns the error that caused the given pair to be missing in the
+// upstream response, nil means the response was successful.
+func failureOf(pair cryptocompare.Pair, err error) error {
+	partial, ok := err.(*cryptocompare.PartialError)
+	if !ok {
+		return err
+	}
+
+	for _, chunk := range partial.Chunks {
+		if contains(chunk.Fsyms, pair.Fsym) &&
+			contains(chunk.Tsyms, pair.Tsym) {
+			return chunk.Err
+		}
+	}
+
+	return nil
+}
+
+func contains(symbols []string, symbol string) bool {
+	for _, item := range symbols {
+		if item == symbol {
+			return true
+		}
+	}
+
+	return false
+}
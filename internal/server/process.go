@@ -4,12 +4,18 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cache"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/events"
 
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
 )
 
 func (server *Server) process(
+	ctx context.Context,
 	response io.Writer,
 	fsyms []string,
 	tsyms []string,
@@ -22,34 +28,70 @@ func (server *Server) process(
 		return errTsymsEmpty
 	}
 
+	// the settings may be reloaded in the meantime
+	settings := server.Settings()
+
+	requested := []cryptocompare.Pair{}
+	for _, fsym := range fsyms {
+		for _, tsym := range tsyms {
+			requested = append(
+				requested,
+				cryptocompare.Pair{Fsym: fsym, Tsym: tsym},
+			)
+		}
+	}
+
+	ttl := 0
+	for _, pair := range requested {
+		if pairTTL := server.pairTTL(settings, pair); pairTTL > ttl {
+			ttl = pairTTL
+		}
+	}
+
 	entities, err := server.cache.Read(
-		context.Background(),
+		ctx,
 		fsyms,
 		tsyms,
-		server.ttl,
+		ttl,
 	)
 	if err != nil {
 		return karma.Format(err, "cache: read data failed")
 	}
 
+	// the pairs may have shorter TTLs than the longest one read with
+	entities = server.expire(settings, entities)
+
+	if settings.revalidates() {
+		// the expired prices are served right away and refreshed later
+		server.revalidate(settings, entities)
+	}
+
 	list := newPriceList(entities)
+	result := &priceResponse{PriceList: list}
 
-	missing := []pair{}
-	for _, fsym := range fsyms {
-		for _, tsym := range tsyms {
-			if !hasRawPrice(list, fsym, tsym) ||
-				!hasDisplayPrice(list, fsym, tsym) {
-				// found a pair that is not in our cache
-				missing = append(
-					missing,
-					pair{fsym: fsym, tsym: tsym},
-				)
-			}
+	missing := []cryptocompare.Pair{}
+	for _, pair := range requested {
+		if hasRawPrice(list, pair.Fsym, pair.Tsym) &&
+			hasDisplayPrice(list, pair.Fsym, pair.Tsym) {
+			continue
+		}
+
+		// known to be absent in the upstream, no need to ask again
+		if reason, ok := server.negative.get(pair); ok {
+			result.addError(pair, reason)
+			continue
 		}
+
+		// found a pair that is not in our cache
+		missing = append(missing, pair)
+	}
+
+	if server.tracker != nil {
+		server.tracker.Touch(requested)
 	}
 
 	if len(missing) == 0 {
-		writeJSON(response, list)
+		writeJSON(response, result)
 		return nil
 	}
 
@@ -60,12 +102,278 @@ func (server *Server) process(
 			Format(nil, "the user requested pairs missing in the cache storage"),
 	)
 
-	upstreamList, err := server.client.GetPriceList(fsyms, tsyms)
+	requestedAt := time.Now()
+
+	upstreamList, err := server.fetch(ctx, missing)
+	upstreamList, err = server.isolate(ctx, missing, upstreamList, err)
+
+	learned := server.negative.learn(missing, upstreamList, err)
+	for pair, reason := range learned {
+		result.addError(pair, reason)
+	}
+
+	if upstreamList != nil {
+		list.Merge(upstreamList)
+
+		if server.tracker != nil {
+			server.tracker.Track(received(missing, upstreamList))
+		}
+	}
+
 	if err != nil {
-		return karma.Format(err, "upstream: request price list failed")
+		// the pairs that are neither received nor known to be absent
+		failed := []cryptocompare.Pair{}
+		for _, pair := range missing {
+			_, absent := learned[pair]
+			received := hasRawPrice(list, pair.Fsym, pair.Tsym) &&
+				hasDisplayPrice(list, pair.Fsym, pair.Tsym)
+			if absent || received {
+				continue
+			}
+
+			failed = append(failed, pair)
+		}
+
+		stale := server.serveStale(ctx, settings, result, entities, failed)
+
+		// the request fails only if there is nothing to serve, the fresh
+		// cached prices are served along with the errors of the rest pairs
+		if upstreamList == nil && len(stale) == 0 && len(entities) == 0 &&
+			len(learned) < len(missing) {
+			return karma.Format(err, "upstream: request price list failed")
+		}
+
+		for _, pair := range failed {
+			if !stale[pair] {
+				result.addError(pair, "upstream: request price list failed")
+			}
+		}
+
+		// the failed prices are either stale or described in the response
+		log.Errorf(err, "upstream: some of the price list requests failed")
 	}
 
-	writeJSON(response, upstreamList)
+	writeJSON(response, result)
+
+	if settings.WriteThrough && upstreamList != nil {
+		// the response is only written into the buffer of the handler, so
+		// the client waits for the cache write too, but the prices are
+		// served from the cache to the subsequent requests at once
+		server.writeCache(ctx, requestedAt, upstreamList)
+	}
 
 	return nil
 }
+
+// pairTTL returns a maximum age (seconds) of a cached price of the given pair
+// to be served: the soft TTL of the pair, or the hard TTL if it's longer and
+// the expired prices are revalidated.
+func (server *Server) pairTTL(
+	settings Settings,
+	pair cryptocompare.Pair,
+) int {
+	ttl := server.softTTL(settings, pair)
+	if settings.revalidates() && settings.HardTTL > ttl {
+		ttl = settings.HardTTL
+	}
+
+	return ttl
+}
+
+// softTTL returns a maximum age (seconds) of a cached price of the given
+// pair to be served without a refresh: the TTL of the pair's tier or the
+// server's TTL.
+func (server *Server) softTTL(
+	settings Settings,
+	pair cryptocompare.Pair,
+) int {
+	if tierTTL := settings.TTLs[pair]; tierTTL > 0 {
+		return tierTTL
+	}
+
+	return settings.TTL
+}
+
+// expire drops the given entities older than the TTLs of their pairs.
+func (server *Server) expire(
+	settings Settings,
+	entities []cache.Entity,
+) []cache.Entity {
+	if len(settings.TTLs) == 0 {
+		// every pair has the same TTL the entities are read with
+		return entities
+	}
+
+	now := time.Now()
+
+	result := []cache.Entity{}
+	for _, entity := range entities {
+		pair := cryptocompare.Pair{
+			Fsym: entity.FromSymbol(),
+			Tsym: entity.ToSymbol(),
+		}
+
+		ttl := time.Duration(server.pairTTL(settings, pair)) * time.Second
+		if now.Sub(entity.StoredAt()) > ttl {
+			continue
+		}
+
+		result = append(result, entity)
+	}
+
+	return result
+}
+
+// serveStale adds the most recent prices of the given pairs into the
+// response if they are not older than the stale-if-error window. If any of
+// the prices is added, the age of every price of the response is described,
+// the ages of the cached prices are taken from the given entities.
+//
+// Returns the pairs added to the response.
+func (server *Server) serveStale(
+	ctx context.Context,
+	settings Settings,
+	result *priceResponse,
+	entities []cache.Entity,
+	pairs []cryptocompare.Pair,
+) map[cryptocompare.Pair]bool {
+	staleIfError := time.Duration(settings.StaleIfError) * time.Second
+	if staleIfError <= 0 || len(pairs) == 0 {
+		return nil
+	}
+
+	fsyms, tsyms := cryptocompare.Symbols(pairs)
+
+	stale, err := server.cache.ReadStale(ctx, fsyms, tsyms)
+	if err != nil {
+		log.Errorf(err, "cache: read stale data failed")
+
+		return nil
+	}
+
+	wanted := map[cryptocompare.Pair]bool{}
+	for _, pair := range pairs {
+		wanted[pair] = true
+	}
+
+	now := time.Now()
+
+	served := map[cryptocompare.Pair]bool{}
+	for _, entity := range stale {
+		pair := cryptocompare.Pair{
+			Fsym: entity.FromSymbol(),
+			Tsym: entity.ToSymbol(),
+		}
+
+		age := now.Sub(entity.StoredAt())
+		if !wanted[pair] || age > staleIfError {
+			continue
+		}
+
+		result.Merge(newPriceList([]cache.Entity{entity}))
+		result.addMeta(pair, pairMeta{
+			Age:   int64(age.Seconds()),
+			Stale: true,
+		})
+
+		served[pair] = true
+	}
+
+	if len(served) == 0 {
+		return nil
+	}
+
+	log.Warningf(
+		nil,
+		"serving %d stale price(s) since the upstream is not available",
+		len(served),
+	)
+
+	// the rest prices are either cached or just received
+	ages := map[cryptocompare.Pair]int64{}
+	for _, entity := range entities {
+		pair := cryptocompare.Pair{
+			Fsym: entity.FromSymbol(),
+			Tsym: entity.ToSymbol(),
+		}
+
+		ages[pair] = int64(now.Sub(entity.StoredAt()).Seconds())
+	}
+
+	for fsym, prices := range result.Raw {
+		for tsym := range prices {
+			pair := cryptocompare.Pair{Fsym: fsym, Tsym: tsym}
+			if served[pair] {
+				continue
+			}
+
+			result.addMeta(pair, pairMeta{Age: ages[pair]})
+		}
+	}
+
+	return served
+}
+
+// received returns the given pairs which prices are in the given list.
+func received(
+	pairs []cryptocompare.Pair,
+	list *cryptocompare.PriceList,
+) []cryptocompare.Pair {
+	result := []cryptocompare.Pair{}
+	for _, pair := range pairs {
+		if hasRawPrice(list, pair.Fsym, pair.Tsym) &&
+			hasDisplayPrice(list, pair.Fsym, pair.Tsym) {
+			result = append(result, pair)
+		}
+	}
+
+	return result
+}
+
+// fetch requests prices of the given pairs only, the pairs are grouped into
+// as few upstream requests as possible and the requests are made
+// concurrently by at most concurrency goroutines.
+//
+// If only some of the requests fail, the merged list of the rest is returned
+// together with *cryptocompare.PartialError.
+func (server *Server) fetch(
+	ctx context.Context,
+	pairs []cryptocompare.Pair,
+) (*cryptocompare.PriceList, error) {
+	return cryptocompare.GetBatches(
+		ctx,
+		server.client,
+		cryptocompare.Batches(pairs),
+		server.concurrency,
+	)
+}
+
+// writeCache writes every price of the given list into the cache storage, so
+// the subsequent requests of the same pairs are served from the cache.
+func (server *Server) writeCache(
+	ctx context.Context,
+	at time.Time,
+	list *cryptocompare.PriceList,
+) {
+	ctx = events.WithSource(ctx, events.SourceServer)
+
+	for fsym, prices := range list.Raw {
+		for tsym, raw := range prices {
+			if !hasDisplayPrice(list, fsym, tsym) {
+				continue
+			}
+
+			err := server.cache.Write(
+				ctx,
+				at,
+				fsym,
+				tsym,
+				raw,
+				list.Display[fsym][tsym],
+			)
+			if err != nil {
+				log.Errorf(err, "cache: write of %s to %s failed", fsym, tsym)
+			}
+		}
+	}
+}
@@ -0,0 +1,560 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cache"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClient returns prices of all requested pairs except the ones of
+// non-existent fsyms. If strict, a request of any non-existent fsym fails
+// as a whole.
+type fakeClient struct {
+	mutex       sync.Mutex
+	calls       [][2][]string
+	nonexistent map[string]bool
+	strict      bool
+	err         error
+}
+
+func (client *fakeClient) GetPriceList(
+	ctx context.Context,
+	fsyms []string,
+	tsyms []string,
+) (*cryptocompare.PriceList, error) {
+	client.mutex.Lock()
+	client.calls = append(client.calls, [2][]string{fsyms, tsyms})
+	client.mutex.Unlock()
+
+	if client.err != nil {
+		return nil, client.err
+	}
+
+	list := &cryptocompare.PriceList{
+		Raw:     map[string]map[string]cryptocompare.RawPrice{},
+		Display: map[string]map[string]cryptocompare.DisplayPrice{},
+	}
+
+	for _, fsym := range fsyms {
+		if client.nonexistent[fsym] {
+			if client.strict {
+				list.Raw = nil
+				break
+			}
+
+			continue
+		}
+
+		list.Raw[fsym] = map[string]cryptocompare.RawPrice{}
+		list.Display[fsym] = map[string]cryptocompare.DisplayPrice{}
+
+		for _, tsym := range tsyms {
+			list.Raw[fsym][tsym] = cryptocompare.RawPrice{Price: 100}
+			list.Display[fsym][tsym] = cryptocompare.DisplayPrice{Price: "100"}
+		}
+	}
+
+	if len(list.Raw) == 0 {
+		return nil, cryptocompare.RemoteError{
+			StatusCode: http.StatusOK,
+			Message:    "cccagg_or_exchange market does not exist",
+		}
+	}
+
+	return list, nil
+}
+
+func newTestServer(t *testing.T) (*Server, cache.Cache, *fakeClient) {
+	storage, err := cache.New(cache.BackendMemory, "", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.Boot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &fakeClient{}
+
+	server, err := New(
+		":0",
+		storage,
+		client,
+		4,
+		nil,
+		nil,
+		Settings{
+			TTL:            60,
+			RequestTimeout: 10,
+			WriteThrough:   true,
+			NegativeTTL:    60,
+			StaleIfError:   3600,
+
+			WebsocketQueueSize: 64,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, storage, client
+}
+
+func TestServer_process_ServesCachedPairs(t *testing.T) {
+	test := assert.New(t)
+
+	server, storage, client := newTestServer(t)
+
+	err := storage.Write(
+		context.Background(),
+		time.Now(),
+		"BTC",
+		"USD",
+		cryptocompare.RawPrice{Price: 1},
+		cryptocompare.DisplayPrice{Price: "1"},
+	)
+	test.NoError(err)
+
+	var response bytes.Buffer
+	err = server.process(
+		context.Background(),
+		&response,
+		[]string{"BTC"},
+		[]string{"USD"},
+	)
+	test.NoError(err)
+	test.Len(client.calls, 0)
+
+	var list cryptocompare.PriceList
+	test.NoError(json.Unmarshal(response.Bytes(), &list))
+	test.Equal(1.0, list.Raw["BTC"]["USD"].Price)
+}
+
+func TestServer_process_RequestsMissingPairs(t *testing.T) {
+	test := assert.New(t)
+
+	server, _, client := newTestServer(t)
+
+	var response bytes.Buffer
+	err := server.process(
+		context.Background(),
+		&response,
+		[]string{"BTC"},
+		[]string{"USD"},
+	)
+	test.NoError(err)
+	test.Len(client.calls, 1)
+
+	var list cryptocompare.PriceList
+	test.NoError(json.Unmarshal(response.Bytes(), &list))
+	test.Equal(100.0, list.Raw["BTC"]["USD"].Price)
+
+	// the upstream response is written through, so the next request is
+	// served from the cache
+	response.Reset()
+	err = server.process(
+		context.Background(),
+		&response,
+		[]string{"BTC"},
+		[]string{"USD"},
+	)
+	test.NoError(err)
+	test.Len(client.calls, 1)
+}
+
+func TestServer_process_RejectsEmptySymbols(t *testing.T) {
+	test := assert.New(t)
+
+	server, _, _ := newTestServer(t)
+
+	var response bytes.Buffer
+	err := server.process(context.Background(), &response, nil, []string{"USD"})
+	test.Equal(errFsymsEmpty, err)
+}
+
+func TestServer_process_RequestsOnlyMissingPairs(t *testing.T) {
+	test := assert.New(t)
+
+	server, storage, client := newTestServer(t)
+
+	err := storage.Write(
+		context.Background(),
+		time.Now(),
+		"BTC",
+		"USD",
+		cryptocompare.RawPrice{Price: 1},
+		cryptocompare.DisplayPrice{Price: "1"},
+	)
+	test.NoError(err)
+
+	var response bytes.Buffer
+	err = server.process(
+		context.Background(),
+		&response,
+		[]string{"BTC", "ETH"},
+		[]string{"USD"},
+	)
+	test.NoError(err)
+
+	if test.Len(client.calls, 1) {
+		test.Equal([]string{"ETH"}, client.calls[0][0])
+		test.Equal([]string{"USD"}, client.calls[0][1])
+	}
+
+	var list cryptocompare.PriceList
+	test.NoError(json.Unmarshal(response.Bytes(), &list))
+	test.Equal(1.0, list.Raw["BTC"]["USD"].Price)
+	test.Equal(100.0, list.Raw["ETH"]["USD"].Price)
+}
+
+func TestServer_process_RemembersNonexistentMarkets(t *testing.T) {
+	test := assert.New(t)
+
+	server, _, client := newTestServer(t)
+	client.nonexistent = map[string]bool{"BLAH": true}
+
+	for i := 0; i < 2; i++ {
+		var response bytes.Buffer
+		err := server.process(
+			context.Background(),
+			&response,
+			[]string{"BTC", "BLAH"},
+			[]string{"USD"},
+		)
+		test.NoError(err)
+
+		var result priceResponse
+		test.NoError(json.Unmarshal(response.Bytes(), &result))
+		test.Equal(100.0, result.Raw["BTC"]["USD"].Price)
+		test.Contains(result.Errors["BLAH"]["USD"], "market does not exist")
+	}
+
+	// the second time BTC is served from the cache and BLAH from the
+	// negative cache
+	test.Len(client.calls, 1)
+
+	var response bytes.Buffer
+	err := server.process(
+		context.Background(),
+		&response,
+		[]string{"BLAH"},
+		[]string{"EUR"},
+	)
+	test.NoError(err)
+	test.Len(client.calls, 2)
+
+	var result priceResponse
+	test.NoError(json.Unmarshal(response.Bytes(), &result))
+	test.Equal(
+		"cccagg_or_exchange market does not exist",
+		result.Errors["BLAH"]["EUR"],
+	)
+}
+
+func TestServer_process_IsolatesNonexistentMarkets(t *testing.T) {
+	test := assert.New(t)
+
+	server, _, client := newTestServer(t)
+	client.nonexistent = map[string]bool{"BLAH": true}
+	client.strict = true
+
+	var response bytes.Buffer
+	err := server.process(
+		context.Background(),
+		&response,
+		[]string{"BTC", "BLAH"},
+		[]string{"USD"},
+	)
+	test.NoError(err)
+
+	var result priceResponse
+	test.NoError(json.Unmarshal(response.Bytes(), &result))
+	test.Equal(100.0, result.Raw["BTC"]["USD"].Price)
+	test.Contains(result.Errors["BLAH"]["USD"], "market does not exist")
+
+	// the failed request is followed by a request of every pair
+	test.Len(client.calls, 3)
+
+	_, absent := server.negative.get(
+		cryptocompare.Pair{Fsym: "BTC", Tsym: "USD"},
+	)
+	test.False(absent)
+
+	_, absent = server.negative.get(
+		cryptocompare.Pair{Fsym: "BLAH", Tsym: "USD"},
+	)
+	test.True(absent)
+}
+
+func TestServer_process_ServesStaleOnError(t *testing.T) {
+	test := assert.New(t)
+
+	server, storage, client := newTestServer(t)
+	client.err = errors.New("upstream is down")
+
+	for fsym, age := range map[string]time.Duration{
+		"BTC":  10 * time.Second,
+		"ETH":  10 * time.Minute,
+		"DOGE": 10 * time.Hour,
+	} {
+		err := storage.Write(
+			context.Background(),
+			time.Now().Add(-age),
+			fsym,
+			"USD",
+			cryptocompare.RawPrice{Price: 1},
+			cryptocompare.DisplayPrice{Price: "1"},
+		)
+		test.NoError(err)
+	}
+
+	var response bytes.Buffer
+	err := server.process(
+		context.Background(),
+		&response,
+		[]string{"BTC", "ETH", "DOGE"},
+		[]string{"USD"},
+	)
+	test.NoError(err)
+
+	var result priceResponse
+	test.NoError(json.Unmarshal(response.Bytes(), &result))
+
+	test.Len(result.Raw, 2)
+
+	test.False(result.Meta["BTC"]["USD"].Stale)
+	test.True(result.Meta["ETH"]["USD"].Stale)
+	test.InDelta(600, result.Meta["ETH"]["USD"].Age, 1)
+
+	// too old to be served even if stale
+	test.NotContains(result.Raw, "DOGE")
+	test.NotEmpty(result.Errors["DOGE"]["USD"])
+}
+
+func TestServer_process_FailsWithoutStalePrices(t *testing.T) {
+	test := assert.New(t)
+
+	server, _, client := newTestServer(t)
+	client.err = errors.New("upstream is down")
+
+	var response bytes.Buffer
+	err := server.process(
+		context.Background(),
+		&response,
+		[]string{"BTC"},
+		[]string{"USD"},
+	)
+	test.Error(err)
+}
+
+func TestServer_process_ServesCachedPairsOnError(t *testing.T) {
+	test := assert.New(t)
+
+	server, storage, client := newTestServer(t)
+	client.err = errors.New("upstream is down")
+
+	// no stale prices are served
+	settings := server.Settings()
+	settings.StaleIfError = 0
+	test.NoError(server.Reload(settings))
+
+	err := storage.Write(
+		context.Background(),
+		time.Now(),
+		"BTC",
+		"USD",
+		cryptocompare.RawPrice{Price: 1},
+		cryptocompare.DisplayPrice{Price: "1"},
+	)
+	test.NoError(err)
+
+	var response bytes.Buffer
+	err = server.process(
+		context.Background(),
+		&response,
+		[]string{"BTC", "ETH"},
+		[]string{"USD"},
+	)
+	test.NoError(err)
+
+	var result priceResponse
+	test.NoError(json.Unmarshal(response.Bytes(), &result))
+
+	test.Equal(1.0, result.Raw["BTC"]["USD"].Price)
+	test.NotContains(result.Raw, "ETH")
+	test.NotEmpty(result.Errors["ETH"]["USD"])
+}
+
+func TestServer_process_RevalidatesExpiredPrices(t *testing.T) {
+	test := assert.New(t)
+
+	storage, err := cache.New(cache.BackendMemory, "", "", "", "", "")
+	test.NoError(err)
+	test.NoError(storage.Boot())
+
+	client := &fakeClient{}
+
+	server, err := New(
+		":0",
+		storage,
+		client,
+		4,
+		nil,
+		nil,
+		Settings{
+			TTL:            60,
+			HardTTL:        600,
+			RequestTimeout: 10,
+			WriteThrough:   true,
+			NegativeTTL:    60,
+			StaleIfError:   3600,
+
+			WebsocketQueueSize: 64,
+		},
+	)
+	test.NoError(err)
+
+	defer server.cancel()
+
+	err = storage.Write(
+		context.Background(),
+		time.Now().Add(-2*time.Minute),
+		"BTC",
+		"USD",
+		cryptocompare.RawPrice{Price: 1},
+		cryptocompare.DisplayPrice{Price: "1"},
+	)
+	test.NoError(err)
+
+	var response bytes.Buffer
+	err = server.process(
+		context.Background(),
+		&response,
+		[]string{"BTC"},
+		[]string{"USD"},
+	)
+	test.NoError(err)
+
+	// the expired price is served right away
+	var list cryptocompare.PriceList
+	test.NoError(json.Unmarshal(response.Bytes(), &list))
+	test.Equal(1.0, list.Raw["BTC"]["USD"].Price)
+
+	go server.serveRevalidation()
+
+	test.Eventually(func() bool {
+		entities, err := storage.Read(
+			context.Background(),
+			[]string{"BTC"},
+			[]string{"USD"},
+			60,
+		)
+
+		return err == nil && len(entities) == 1 &&
+			entities[0].RawPrice().Price == 100
+	}, time.Second, time.Millisecond)
+}
+
+func TestServer_revalidate_UsesTierTTL(t *testing.T) {
+	test := assert.New(t)
+
+	server, storage, _ := newTestServer(t)
+
+	settings := server.Settings()
+	settings.HardTTL = 3600
+	settings.TTLs = map[cryptocompare.Pair]int{
+		{Fsym: "BTC", Tsym: "USD"}: 10,
+		{Fsym: "ETH", Tsym: "USD"}: 600,
+	}
+
+	for _, fsym := range []string{"BTC", "ETH", "XRP"} {
+		err := storage.Write(
+			context.Background(),
+			time.Now().Add(-2*time.Minute),
+			fsym,
+			"USD",
+			cryptocompare.RawPrice{Price: 1},
+			cryptocompare.DisplayPrice{Price: "1"},
+		)
+		test.NoError(err)
+	}
+
+	entities, err := storage.Read(
+		context.Background(),
+		[]string{"BTC", "ETH", "XRP"},
+		[]string{"USD"},
+		3600,
+	)
+	test.NoError(err)
+	test.Len(entities, 3)
+
+	server.revalidate(settings, entities)
+
+	// ETH is fresh according to its tier TTL, XRP has expired according to
+	// the server's TTL
+	test.Equal(
+		map[cryptocompare.Pair]bool{
+			{Fsym: "BTC", Tsym: "USD"}: true,
+			{Fsym: "XRP", Tsym: "USD"}: true,
+		},
+		server.revalidatePending,
+	)
+}
+
+func TestServer_process_UsesTierTTL(t *testing.T) {
+	test := assert.New(t)
+
+	// the tier TTLs are served without the updater, e.g. by a read-only
+	// replica
+	server, storage, client := newTestServer(t)
+	test.Nil(server.tracker)
+
+	settings := server.Settings()
+	settings.TTLs = map[cryptocompare.Pair]int{
+		{Fsym: "BTC", Tsym: "USD"}: 10,
+		{Fsym: "ETH", Tsym: "USD"}: 600,
+	}
+	test.NoError(server.Reload(settings))
+
+	for _, fsym := range []string{"BTC", "ETH", "DOGE"} {
+		err := storage.Write(
+			context.Background(),
+			time.Now().Add(-time.Minute*2),
+			fsym,
+			"USD",
+			cryptocompare.RawPrice{Price: 1},
+			cryptocompare.DisplayPrice{Price: "1"},
+		)
+		test.NoError(err)
+	}
+
+	var response bytes.Buffer
+	err := server.process(
+		context.Background(),
+		&response,
+		[]string{"BTC", "ETH", "DOGE"},
+		[]string{"USD"},
+	)
+	test.NoError(err)
+
+	// the price of ETH is fresh enough for its tier, BTC expires sooner and
+	// DOGE expires according to the server's TTL
+	if test.Len(client.calls, 1) {
+		test.Equal([]string{"BTC", "DOGE"}, client.calls[0][0])
+	}
+
+	var list cryptocompare.PriceList
+	test.NoError(json.Unmarshal(response.Bytes(), &list))
+	test.Equal(1.0, list.Raw["ETH"]["USD"].Price)
+	test.Equal(100.0, list.Raw["BTC"]["USD"].Price)
+}
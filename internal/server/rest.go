@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"strings"
@@ -15,12 +16,28 @@ func (server *Server) handleREST(
 	response http.ResponseWriter,
 	request *http.Request,
 ) {
-	fsyms := strings.Split(request.URL.Query().Get("fsyms"), ",")
-	tsyms := strings.Split(request.URL.Query().Get("tsyms"), ",")
+	fsyms, tsyms := parseSymbols(request)
 
-	err := server.process(response, fsyms, tsyms)
+	ctx, cancel := context.WithTimeout(
+		request.Context(),
+		server.Settings().requestTimeout(),
+	)
+	defer cancel()
+
+	err := server.process(ctx, response, fsyms, tsyms)
 	if err != nil {
 		writeErrorJSON(response, err)
 		return
 	}
 }
+
+// parseSymbols returns the comma-separated fsyms and tsyms of the given
+// request query.
+func parseSymbols(request *http.Request) ([]string, []string) {
+	query := request.URL.Query()
+
+	fsyms := strings.Split(query.Get("fsyms"), ",")
+	tsyms := strings.Split(query.Get("tsyms"), ",")
+
+	return fsyms, tsyms
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cache"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/reconquest/pkg/log"
+)
+
+const (
+	// revalidateQueueSize is a number of pairs waiting for a refresh, pairs
+	// are dropped if the queue is full, they will be queued again by the
+	// next request anyway.
+	revalidateQueueSize = 1024
+
+	// revalidateBatchSize is a maximum number of pairs refreshed at once.
+	revalidateBatchSize = 100
+)
+
+// Tracker knows pairs refreshed by the updater, such pairs are never
+// revalidated by the server. The tracker is told about the requested pairs,
+// so it can start refreshing them.
+type Tracker interface {
+	// Tracks returns true if the pair is refreshed by the tracker.
+	Tracks(pair cryptocompare.Pair) bool
+
+	// Track asks to refresh the pairs received from the upstream since they
+	// were missing in the cache.
+	Track(pairs []cryptocompare.Pair)
+
+	// Touch tells the tracker the pairs have been requested.
+	Touch(pairs []cryptocompare.Pair)
+}
+
+// revalidate queues refreshing of the pairs of the given entities that have
+// expired according to the soft TTLs of their pairs.
+func (server *Server) revalidate(settings Settings, entities []cache.Entity) {
+	now := time.Now()
+
+	server.revalidateMutex.Lock()
+	defer server.revalidateMutex.Unlock()
+
+	for _, entity := range entities {
+		pair := cryptocompare.Pair{
+			Fsym: entity.FromSymbol(),
+			Tsym: entity.ToSymbol(),
+		}
+
+		ttl := time.Duration(server.softTTL(settings, pair)) * time.Second
+		if now.Sub(entity.StoredAt()) <= ttl {
+			continue
+		}
+
+		if server.revalidatePending[pair] {
+			continue
+		}
+
+		if server.tracker != nil && server.tracker.Tracks(pair) {
+			continue
+		}
+
+		select {
+		case server.revalidateQueue <- pair:
+			server.revalidatePending[pair] = true
+		default:
+			log.Warningf(nil, "revalidate: queue is full, %s is dropped", pair)
+		}
+	}
+}
+
+// serveRevalidation refreshes the queued pairs until the server is closed.
+func (server *Server) serveRevalidation() {
+	for {
+		var batch []cryptocompare.Pair
+
+		select {
+		case pair := <-server.revalidateQueue:
+			batch = append(batch, pair)
+		case <-server.context.Done():
+			return
+		}
+
+		// the rest queued pairs are refreshed together
+	collect:
+		for len(batch) < revalidateBatchSize {
+			select {
+			case pair := <-server.revalidateQueue:
+				batch = append(batch, pair)
+			default:
+				break collect
+			}
+		}
+
+		server.refresh(batch)
+
+		server.revalidateMutex.Lock()
+		for _, pair := range batch {
+			delete(server.revalidatePending, pair)
+		}
+		server.revalidateMutex.Unlock()
+	}
+}
+
+func (server *Server) refresh(pairs []cryptocompare.Pair) {
+	log.Debugf(nil, "revalidate: refreshing %d pair(s)", len(pairs))
+
+	ctx, cancel := context.WithTimeout(
+		server.context,
+		server.Settings().requestTimeout(),
+	)
+	defer cancel()
+
+	// refreshing is not urgent, the prices are served anyway
+	ctx = cryptocompare.WithBackgroundPriority(ctx)
+
+	requestedAt := time.Now()
+
+	list, err := server.fetch(ctx, pairs)
+	if err != nil {
+		log.Errorf(err, "revalidate: unable to refresh prices")
+	}
+
+	if list != nil {
+		server.writeCache(ctx, requestedAt, list)
+	}
+}
@@ -1,11 +1,15 @@
 package server
 
 import (
+	"context"
+	"net"
 	"net/http"
+	"sync"
 
 	"github.com/gorilla/websocket"
 	"github.com/kovetskiy/cryptocompare-proxyd/internal/cache"
 	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/events"
 	"github.com/reconquest/pkg/log"
 )
 
@@ -23,7 +27,39 @@ type Server struct {
 
 	cache  cache.Cache
 	client cryptocompare.Client
-	ttl    int
+
+	// concurrency is a maximum number of upstream requests made at once to
+	// serve a single request.
+	concurrency int
+
+	tracker Tracker
+
+	revalidateQueue   chan cryptocompare.Pair
+	revalidatePending map[cryptocompare.Pair]bool
+	revalidateMutex   sync.Mutex
+
+	settings      Settings
+	settingsMutex sync.RWMutex
+
+	negative *negativeCache
+
+	// bus publishes the written prices, the changed ones are pushed to the
+	// subscribed websocket connections. Nothing is pushed if it's nil.
+	bus *events.Bus
+
+	websocketMetrics *websocketMetrics
+
+	// history keeps the recent changes published to the bus, so the stream
+	// clients may receive the changes missed while reconnecting.
+	history *history
+
+	// context is the parent of all requests contexts, it's cancelled when the
+	// server is closed so the in-flight work is cancelled too.
+	context context.Context
+	cancel  context.CancelFunc
+
+	status      map[string]func() interface{}
+	statusMutex sync.Mutex
 }
 
 // New instance of Server.
@@ -31,13 +67,39 @@ func New(
 	listenAddress string,
 	cache cache.Cache,
 	client cryptocompare.Client,
-	ttl int,
+	concurrency int,
+	tracker Tracker,
+	bus *events.Bus,
+	settings Settings,
 ) (*Server, error) {
+	err := settings.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &Server{
-		listenAddress: listenAddress,
-		cache:         cache,
-		client:        client,
-		ttl:           ttl,
+		listenAddress:     listenAddress,
+		cache:             cache,
+		client:            client,
+		concurrency:       concurrency,
+		tracker:           tracker,
+		revalidateQueue:   make(chan cryptocompare.Pair, revalidateQueueSize),
+		revalidatePending: map[cryptocompare.Pair]bool{},
+		settings:          settings,
+		negative:          newNegativeCache(settings.NegativeTTL),
+		bus:               bus,
+		history:           newHistory(historySize),
+		websocketMetrics:  &websocketMetrics{},
+		websocket: &websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin:     func(*http.Request) bool { return true },
+		},
+		context: ctx,
+		cancel:  cancel,
+		status:  map[string]func() interface{}{},
 	}, nil
 }
 
@@ -46,21 +108,26 @@ func (server *Server) ListenAndServe() error {
 	server.http = &http.Server{
 		Handler: server,
 		Addr:    server.listenAddress,
+		BaseContext: func(net.Listener) context.Context {
+			return server.context
+		},
 	}
 
-	server.websocket = &websocket.Upgrader{
-		ReadBufferSize:  1,
-		WriteBufferSize: 1,
-		CheckOrigin:     func(*http.Request) bool { return true },
-	}
+	// the revalidation may be enabled by reloading the settings
+	go server.serveRevalidation()
+
+	go server.serveHistory()
 
 	log.Infof(nil, "the http server starting at %s", server.listenAddress)
 
 	return server.http.ListenAndServe()
 }
 
-// Close immediately closes all active http connections.
+// Close immediately closes all active http connections and cancels all
+// in-flight requests, including websocket connections.
 func (server *Server) Close() error {
+	server.cancel()
+
 	return server.http.Close()
 }
 
@@ -82,7 +149,12 @@ func (server *Server) ServeHTTP(
 	hasQuery := len(request.URL.Query()) > 0
 
 	tag := "REST"
-	if !hasQuery {
+	switch {
+	case request.URL.Path == statusPath:
+		tag = "STATUS"
+	case request.URL.Path == streamPath:
+		tag = "STREAM"
+	case !hasQuery:
 		tag = "WEBSOCKET"
 	}
 
@@ -97,6 +169,12 @@ func (server *Server) ServeHTTP(
 	)
 
 	switch {
+	case request.URL.Path == statusPath:
+		server.handleStatus(response, request)
+
+	case request.URL.Path == streamPath:
+		server.handleStream(response, request)
+
 	case request.URL.Path == apiPath && hasQuery:
 		server.handleREST(response, request)
 
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/reconquest/pkg/log"
+)
+
+// Settings are the settings of Server which can be changed while it's
+// running, see Reload.
+type Settings struct {
+	// TTL is a soft TTL (seconds): prices older than that are either
+	// requested from the upstream or revalidated in the background until they
+	// are older than HardTTL.
+	TTL     int
+	HardTTL int
+
+	// TTLs are the TTLs (seconds) of the pairs served with a TTL of their
+	// own, e.g. the pairs of a tier, the rest are served with TTL.
+	TTLs map[cryptocompare.Pair]int
+
+	// RequestTimeout (seconds) bounds processing of every REST request and
+	// every websocket query, including the cache and upstream calls.
+	RequestTimeout int
+
+	// WriteThrough enables writing prices received from the upstream into
+	// the cache storage.
+	WriteThrough bool
+
+	// NegativeTTL is a duration of time (seconds) to remember pairs which
+	// markets don't exist.
+	NegativeTTL int
+
+	// StaleIfError is a maximum age (seconds) of a price which is served
+	// instead of an error if the upstream is not available.
+	StaleIfError int
+
+	// WebsocketPingInterval is a duration of time (seconds) between
+	// keepalive pings sent to websocket clients, no pings are sent if it's
+	// zero.
+	WebsocketPingInterval int
+
+	// WebsocketIdleTimeout is a duration of time (seconds) a websocket
+	// client is disconnected after if it sends neither a message nor a pong
+	// or doesn't receive a message in time, clients are never disconnected
+	// if it's zero.
+	WebsocketIdleTimeout int
+
+	// WebsocketMaxMessageSize is a maximum size (bytes) of a message received
+	// from a websocket client, it's not limited if it's zero.
+	WebsocketMaxMessageSize int64
+
+	// WebsocketQueueSize is a number of messages waiting to be sent to a
+	// websocket client, the client is disconnected once the queue is full.
+	WebsocketQueueSize int
+
+	// WebsocketMaxConnections is a maximum number of open websocket
+	// connections, the rest are rejected. It's not limited if it's zero.
+	WebsocketMaxConnections int
+}
+
+// Validate returns an error if the settings are not valid.
+func (settings Settings) Validate() error {
+	if settings.TTL <= 0 {
+		return fmt.Errorf("ttl should be positive, but got %d", settings.TTL)
+	}
+
+	if settings.RequestTimeout <= 0 {
+		return fmt.Errorf(
+			"request timeout should be positive, but got %d",
+			settings.RequestTimeout,
+		)
+	}
+
+	if settings.HardTTL < 0 ||
+		settings.NegativeTTL < 0 ||
+		settings.StaleIfError < 0 {
+		return fmt.Errorf(
+			"hard ttl, negative ttl and stale-if-error should not be negative",
+		)
+	}
+
+	if settings.WebsocketPingInterval < 0 ||
+		settings.WebsocketIdleTimeout < 0 ||
+		settings.WebsocketMaxMessageSize < 0 ||
+		settings.WebsocketMaxConnections < 0 {
+		return fmt.Errorf(
+			"websocket ping interval, idle timeout, max message size " +
+				"and max connections should not be negative",
+		)
+	}
+
+	if settings.WebsocketQueueSize <= 0 {
+		return fmt.Errorf(
+			"websocket queue size should be positive, but got %d",
+			settings.WebsocketQueueSize,
+		)
+	}
+
+	// the clients answering the pings should not be considered idle
+	if settings.WebsocketPingInterval > 0 &&
+		settings.WebsocketIdleTimeout > 0 &&
+		settings.WebsocketPingInterval >= settings.WebsocketIdleTimeout {
+		return fmt.Errorf(
+			"websocket ping interval should be less than idle timeout, "+
+				"but got %d and %d",
+			settings.WebsocketPingInterval,
+			settings.WebsocketIdleTimeout,
+		)
+	}
+
+	return nil
+}
+
+// revalidates returns true if the prices expired according to the soft TTL
+// are served and refreshed in the background until they expire according to
+// the hard TTL.
+func (settings Settings) revalidates() bool {
+	// there is no point in refreshing prices that are not written
+	return settings.WriteThrough && settings.HardTTL > settings.TTL
+}
+
+func (settings Settings) requestTimeout() time.Duration {
+	return time.Duration(settings.RequestTimeout) * time.Second
+}
+
+func (settings Settings) websocketPingInterval() time.Duration {
+	return time.Duration(settings.WebsocketPingInterval) * time.Second
+}
+
+func (settings Settings) websocketIdleTimeout() time.Duration {
+	return time.Duration(settings.WebsocketIdleTimeout) * time.Second
+}
+
+// Settings returns the current settings of the server.
+func (server *Server) Settings() Settings {
+	server.settingsMutex.RLock()
+	defer server.settingsMutex.RUnlock()
+
+	return server.settings
+}
+
+// Reload validates and applies the given settings, the requests in progress
+// keep using the settings they have started with.
+func (server *Server) Reload(settings Settings) error {
+	err := settings.Validate()
+	if err != nil {
+		return err
+	}
+
+	server.settingsMutex.Lock()
+	defer server.settingsMutex.Unlock()
+
+	server.settings = settings
+	server.negative.setTTL(settings.NegativeTTL)
+
+	log.Infof(nil, "the http server settings are reloaded")
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_Reload_AppliesValidSettingsOnly(t *testing.T) {
+	test := assert.New(t)
+
+	server, _, _ := newTestServer(t)
+
+	settings := server.Settings()
+	settings.TTL = 30
+	settings.NegativeTTL = 10
+
+	test.NoError(server.Reload(settings))
+	test.Equal(30, server.Settings().TTL)
+	test.Equal(10*time.Second, server.negative.ttl)
+
+	settings.TTL = 0
+
+	test.Error(server.Reload(settings))
+	test.Equal(30, server.Settings().TTL)
+}
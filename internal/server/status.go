@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/http"
+)
+
+const (
+	statusPath = "/api/v1/status"
+)
+
+// AddStatus registers a section of the status endpoint, the provider is
+// invoked on every request and its result is encoded as JSON under the given
+// name.
+func (server *Server) AddStatus(name string, provider func() interface{}) {
+	server.statusMutex.Lock()
+	defer server.statusMutex.Unlock()
+
+	server.status[name] = provider
+}
+
+func (server *Server) handleStatus(
+	response http.ResponseWriter,
+	request *http.Request,
+) {
+	server.statusMutex.Lock()
+	defer server.statusMutex.Unlock()
+
+	status := map[string]interface{}{}
+	for name, provider := range server.status {
+		status[name] = provider()
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+
+	writeJSON(response, status)
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/reconquest/pkg/log"
+)
+
+const (
+	streamPath = "/api/v1/price/stream"
+
+	// streamKeepAliveInterval is a duration of time between comments sent
+	// to the stream clients, so idle connections are not closed by proxies.
+	streamKeepAliveInterval = 15 * time.Second
+)
+
+// handleStream streams the changes of the requested prices as server-sent
+// events: the current prices are sent first as the snapshot event, then every
+// change is sent as the update event. A client reconnecting with the
+// Last-Event-ID header receives the changes it has missed, or the snapshot
+// again if they are not kept anymore.
+func (server *Server) handleStream(
+	response http.ResponseWriter,
+	request *http.Request,
+) {
+	fsyms, tsyms := parseSymbols(request)
+
+	pairs, err := queriedPairs(fsyms, tsyms)
+	if err != nil {
+		writeErrorJSON(response, err)
+		return
+	}
+
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		response.WriteHeader(http.StatusInternalServerError)
+		writeErrorJSON(response, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	requested := map[cryptocompare.Pair]bool{}
+	for _, pair := range pairs {
+		requested[pair] = true
+	}
+
+	ctx := request.Context()
+
+	cursor, resumed := server.history.parseID(
+		request.Header.Get("Last-Event-ID"),
+	)
+	if resumed {
+		_, resumed = server.history.since(cursor)
+	}
+
+	// the snapshot is taken before the stream is started, so the client gets
+	// a regular error response if the prices can't be retrieved
+	var snapshot []byte
+	if !resumed {
+		cursor = server.history.cursor()
+
+		snapshot, err = server.snapshot(ctx, fsyms, tsyms)
+		if err != nil {
+			writeErrorJSON(response, err)
+			return
+		}
+	}
+
+	headers := response.Header()
+	headers.Set("Content-Type", "text/event-stream")
+	headers.Set("Cache-Control", "no-cache")
+	headers.Set("X-Accel-Buffering", "no")
+
+	keepAlive := time.NewTicker(streamKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	touch := time.NewTicker(subscriptionTouchInterval)
+	defer touch.Stop()
+
+	for {
+		if snapshot != nil {
+			writeStreamEvent(
+				response,
+				server.history.formatID(cursor),
+				messageSnapshot,
+				snapshot,
+			)
+
+			snapshot = nil
+		}
+
+		// taken before the changes are read, so no change is missed
+		appended := server.history.wait()
+
+		changes, ok := server.history.since(cursor)
+		if !ok {
+			log.Warningf(
+				nil,
+				"stream: the client has fallen behind, sending the snapshot",
+			)
+
+			cursor = server.history.cursor()
+
+			snapshot, err = server.snapshot(ctx, fsyms, tsyms)
+			if err != nil {
+				log.Errorf(err, "stream: unable to take the snapshot")
+				return
+			}
+
+			continue
+		}
+
+		for _, change := range changes {
+			cursor = change.id
+
+			if !requested[change.event.Pair] {
+				continue
+			}
+
+			update := &cryptocompare.PriceList{}
+			update.Set(
+				change.event.Pair,
+				change.event.New,
+				change.event.Display,
+			)
+
+			data, err := json.Marshal(update)
+			if err != nil {
+				log.Errorf(err, "stream: unable to marshal update")
+				continue
+			}
+
+			writeStreamEvent(
+				response,
+				server.history.formatID(cursor),
+				messageUpdate,
+				data,
+			)
+		}
+
+		flusher.Flush()
+
+		select {
+		case <-appended:
+			//
+		case <-keepAlive.C:
+			fmt.Fprint(response, ": keep-alive\n\n")
+		case <-touch.C:
+			if server.tracker != nil {
+				server.tracker.Touch(pairs)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// snapshot returns the current prices of the given symbols.
+func (server *Server) snapshot(
+	ctx context.Context,
+	fsyms []string,
+	tsyms []string,
+) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, server.Settings().requestTimeout())
+	defer cancel()
+
+	var snapshot bytes.Buffer
+	err := server.process(ctx, &snapshot, fsyms, tsyms)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSpace(snapshot.Bytes()), nil
+}
+
+// writeStreamEvent writes a server-sent event, the data is expected to be a
+// single line.
+func writeStreamEvent(writer io.Writer, id string, name string, data []byte) {
+	if id != "" {
+		fmt.Fprintf(writer, "id: %s\n", id)
+	}
+
+	fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", name, data)
+}
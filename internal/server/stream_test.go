@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/events"
+	"github.com/stretchr/testify/assert"
+)
+
+type testStreamEvent struct {
+	id   string
+	name string
+	data string
+}
+
+func readStreamEvent(t *testing.T, reader *bufio.Reader) testStreamEvent {
+	var event testStreamEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return event
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event.name != "":
+			return event
+		case strings.HasPrefix(line, "id: "):
+			event.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestServer_handleStream_SendsSnapshotAndMissedUpdates(t *testing.T) {
+	test := assert.New(t)
+
+	server, storage, _ := newTestServer(t)
+	defer server.cancel()
+
+	server.bus = events.NewBus()
+	server.cache = events.NewCache(storage, server.bus)
+
+	write := func(price float64) {
+		err := server.cache.Write(
+			context.Background(),
+			time.Now(),
+			"BTC",
+			"USD",
+			cryptocompare.RawPrice{Price: price},
+			cryptocompare.DisplayPrice{Price: "1"},
+		)
+		test.NoError(err)
+	}
+
+	write(1)
+
+	go server.serveHistory()
+
+	// the changes are added to the history once it's subscribed to the bus
+	for server.bus.Status().Subscribers == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	open := func(lastEventID string) (*bufio.Reader, func()) {
+		request, err := http.NewRequest(
+			http.MethodGet,
+			httpServer.URL+streamPath+"?fsyms=BTC&tsyms=USD",
+			nil,
+		)
+		test.NoError(err)
+
+		if lastEventID != "" {
+			request.Header.Set("Last-Event-ID", lastEventID)
+		}
+
+		response, err := http.DefaultClient.Do(request)
+		if !test.NoError(err) {
+			t.FailNow()
+		}
+
+		test.Equal("text/event-stream", response.Header.Get("Content-Type"))
+
+		return bufio.NewReader(response.Body), func() {
+			response.Body.Close()
+		}
+	}
+
+	reader, closeStream := open("")
+
+	snapshot := readStreamEvent(t, reader)
+	test.Equal(messageSnapshot, snapshot.name)
+
+	var answer priceResponse
+	test.NoError(json.Unmarshal([]byte(snapshot.data), &answer))
+	test.Equal(1.0, answer.Raw["BTC"]["USD"].Price)
+
+	write(2)
+
+	update := readStreamEvent(t, reader)
+	test.Equal(messageUpdate, update.name)
+	test.NotEqual(snapshot.id, update.id)
+
+	var prices cryptocompare.PriceList
+	test.NoError(json.Unmarshal([]byte(update.data), &prices))
+	test.Equal(2.0, prices.Raw["BTC"]["USD"].Price)
+
+	closeStream()
+
+	// the client reconnecting after the snapshot receives the missed update
+	reader, closeStream = open(snapshot.id)
+	defer closeStream()
+
+	replayed := readStreamEvent(t, reader)
+	test.Equal(update, replayed)
+
+	// the unknown ids are answered with the snapshot
+	reader, closeUnknown := open("unknown-1")
+	defer closeUnknown()
+
+	test.Equal(messageSnapshot, readStreamEvent(t, reader).name)
+}
+
+func TestHistory_since_RejectsCursorsBeforeLostChanges(t *testing.T) {
+	test := assert.New(t)
+
+	history := newHistory(8)
+	history.append(events.Event{})
+	history.append(events.Event{})
+
+	history.lose()
+	history.append(events.Event{})
+
+	_, ok := history.since(1)
+	test.False(ok)
+
+	_, ok = history.since(2)
+	test.False(ok)
+
+	changes, ok := history.since(3)
+	test.True(ok)
+	test.Empty(changes)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/events"
+)
+
+const (
+	// subscriberQueueSize is a number of updates waiting to be sent to a
+	// subscriber, the oldest updates are dropped if the queue is full.
+	subscriberQueueSize = 64
+
+	// subscriptionTouchInterval is a duration of time between telling the
+	// tracker the subscribed pairs are still requested, so the pairs
+	// tracked due to demand are not dropped while somebody is subscribed.
+	subscriptionTouchInterval = time.Minute
+)
+
+// subscriber is a websocket connection subscribed to updates of some pairs.
+type subscriber struct {
+	pairs map[cryptocompare.Pair]bool
+	mutex sync.Mutex
+}
+
+func newSubscriber() *subscriber {
+	return &subscriber{
+		pairs: map[cryptocompare.Pair]bool{},
+	}
+}
+
+// subscribe subscribes to the given pairs and returns the pairs that were
+// not subscribed before.
+func (subscriber *subscriber) subscribe(
+	pairs []cryptocompare.Pair,
+) []cryptocompare.Pair {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	added := []cryptocompare.Pair{}
+	for _, pair := range pairs {
+		if !subscriber.pairs[pair] {
+			subscriber.pairs[pair] = true
+			added = append(added, pair)
+		}
+	}
+
+	return added
+}
+
+func (subscriber *subscriber) unsubscribe(pairs []cryptocompare.Pair) {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	for _, pair := range pairs {
+		delete(subscriber.pairs, pair)
+	}
+}
+
+// subscribed returns the subscribed pairs.
+func (subscriber *subscriber) subscribed() []cryptocompare.Pair {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	pairs := []cryptocompare.Pair{}
+	for pair := range subscriber.pairs {
+		pairs = append(pairs, pair)
+	}
+
+	return pairs
+}
+
+// wants returns true if the given event is a change of a subscribed pair.
+func (subscriber *subscriber) wants(event events.Event) bool {
+	if !event.Changed() {
+		return false
+	}
+
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	return subscriber.pairs[event.Pair]
+}
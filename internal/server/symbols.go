@@ -5,11 +5,6 @@ import (
 	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
 )
 
-type pair struct {
-	fsym string
-	tsym string
-}
-
 func hasRawPrice(
 	list *cryptocompare.PriceList,
 	fsym string,
@@ -1,21 +1,78 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/events"
 	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
 )
 
+const (
+	// actionSubscribe subscribes the connection to updates of the queried
+	// pairs, the current prices are sent right away.
+	actionSubscribe = "subscribe"
+
+	// actionUnsubscribe stops sending updates of the queried pairs.
+	actionUnsubscribe = "unsubscribe"
+
+	messageSnapshot     = "snapshot"
+	messageUpdate       = "update"
+	messageUnsubscribed = "unsubscribed"
+)
+
+var errTooManyConnections = errors.New("too many websocket connections")
+
+// websocketQuery is a message received from a websocket client, the queried
+// prices are sent once if no action is specified.
 type websocketQuery struct {
-	Fsyms []string `json:"fsyms"`
-	Tsyms []string `json:"tsyms"`
+	Action string   `json:"action,omitempty"`
+	Fsyms  []string `json:"fsyms"`
+	Tsyms  []string `json:"tsyms"`
+}
+
+// websocketMessage is a message sent to a subscribed websocket client, the
+// answers to queries without an action are sent as is.
+type websocketMessage struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
 }
 
 func (server *Server) handleWebsocket(
 	response http.ResponseWriter,
 	request *http.Request,
 ) {
+	// the settings may be reloaded in the meantime
+	settings := server.Settings()
+
+	if !server.acquireConnection(settings.WebsocketMaxConnections) {
+		log.Warningf(
+			nil,
+			"websocket: rejecting the connection from %s, "+
+				"the limit of %d connections is reached",
+			request.RemoteAddr,
+			settings.WebsocketMaxConnections,
+		)
+
+		response.WriteHeader(http.StatusServiceUnavailable)
+		writeErrorJSON(response, errTooManyConnections)
+
+		return
+	}
+
+	defer server.releaseConnection()
+
 	connection, err := server.websocket.Upgrade(response, request, nil)
 	if err != nil {
 		writeErrorJSON(response, err)
@@ -24,17 +81,85 @@ func (server *Server) handleWebsocket(
 
 	defer connection.Close()
 
-	wsWriter := websocketWriter{connection: connection}
+	server.acceptConnection()
+
+	connection.SetReadLimit(settings.WebsocketMaxMessageSize)
+
+	// the client is alive as long as it sends messages or answers the pings
+	idleTimeout := settings.websocketIdleTimeout()
+	prolong := func() error {
+		if idleTimeout == 0 {
+			return nil
+		}
+
+		return connection.SetReadDeadline(time.Now().Add(idleTimeout))
+	}
+
+	connection.SetPongHandler(func(string) error {
+		return prolong()
+	})
+
+	// the request context is not cancelled when a hijacked connection is
+	// closed, but it is cancelled when the server shuts down, so we close the
+	// connection to interrupt the blocking read below.
+	ctx, cancel := context.WithCancel(request.Context())
+
+	go func() {
+		<-ctx.Done()
+		connection.Close()
+	}()
+
+	wsWriter := newWebsocketWriter(
+		connection,
+		server.websocketMetrics,
+		settings.WebsocketQueueSize,
+	)
+
+	subscriber := newSubscriber()
+
+	var workers sync.WaitGroup
+	defer func() {
+		cancel()
+		workers.Wait()
+		wsWriter.discard()
+	}()
+
+	workers.Add(2)
+
+	// the connection is closed once the client fails to receive messages
+	go func() {
+		defer workers.Done()
+		defer cancel()
+
+		wsWriter.serve(ctx, settings.websocketPingInterval(), idleTimeout)
+	}()
+
+	go func() {
+		defer workers.Done()
+
+		server.push(ctx, wsWriter, subscriber)
+	}()
 
 	for {
+		err := prolong()
+		if err != nil {
+			break
+		}
+
 		_, reader, err := connection.NextReader()
 		if err != nil {
+			server.countClosed(err)
 			break
 		}
 
 		var query websocketQuery
 		err = json.NewDecoder(reader).Decode(&query)
 		if err != nil {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				server.countClosed(err)
+				return
+			}
+
 			writeErrorJSON(
 				wsWriter,
 				karma.Format(err, "json decoding failed"),
@@ -43,9 +168,163 @@ func (server *Server) handleWebsocket(
 			return
 		}
 
-		err = server.process(wsWriter, query.Fsyms, query.Tsyms)
+		queryCtx, cancelQuery := context.WithTimeout(
+			ctx,
+			settings.requestTimeout(),
+		)
+		err = server.handleQuery(queryCtx, wsWriter, subscriber, query)
+		cancelQuery()
 		if err != nil {
 			writeErrorJSON(wsWriter, err)
 		}
 	}
 }
+
+// countClosed counts the connection closed due to the given read error if
+// it's the idle timeout or the message size limit.
+func (server *Server) countClosed(err error) {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, websocket.ErrReadLimit):
+		atomic.AddInt64(&server.websocketMetrics.oversized, 1)
+
+		log.Warningf(nil, "websocket: the client sent a too large message")
+
+	case errors.As(err, &netErr) && netErr.Timeout():
+		atomic.AddInt64(&server.websocketMetrics.idleTimeouts, 1)
+
+		log.Debugf(nil, "websocket: disconnecting the idle client")
+	}
+}
+
+// handleQuery answers the given query of a websocket client.
+func (server *Server) handleQuery(
+	ctx context.Context,
+	wsWriter *websocketWriter,
+	subscriber *subscriber,
+	query websocketQuery,
+) error {
+	switch query.Action {
+	case "":
+		return server.process(ctx, wsWriter, query.Fsyms, query.Tsyms)
+
+	case actionSubscribe:
+		pairs, err := queriedPairs(query.Fsyms, query.Tsyms)
+		if err != nil {
+			return err
+		}
+
+		// subscribed before the snapshot is taken, so no update is missed,
+		// the client is not subscribed if the snapshot fails though
+		added := subscriber.subscribe(pairs)
+
+		var snapshot bytes.Buffer
+		err = server.process(ctx, &snapshot, query.Fsyms, query.Tsyms)
+		if err != nil {
+			subscriber.unsubscribe(added)
+
+			return err
+		}
+
+		writeJSON(wsWriter, websocketMessage{
+			Type: messageSnapshot,
+			Data: json.RawMessage(snapshot.Bytes()),
+		})
+
+		return nil
+
+	case actionUnsubscribe:
+		pairs, err := queriedPairs(query.Fsyms, query.Tsyms)
+		if err != nil {
+			return err
+		}
+
+		subscriber.unsubscribe(pairs)
+
+		writeJSON(wsWriter, websocketMessage{
+			Type: messageUnsubscribed,
+			Data: query,
+		})
+
+		return nil
+
+	default:
+		return fmt.Errorf("unknown action: %q", query.Action)
+	}
+}
+
+// push sends the changes of the subscribed pairs published to the bus until
+// the given context is cancelled.
+func (server *Server) push(
+	ctx context.Context,
+	wsWriter *websocketWriter,
+	subscriber *subscriber,
+) {
+	var updates <-chan events.Event
+	if server.bus != nil {
+		subscription := server.bus.Subscribe(
+			subscriberQueueSize,
+			events.DropOldest,
+			subscriber.wants,
+		)
+		defer subscription.Close()
+
+		updates = subscription.Events()
+	}
+
+	ticker := time.NewTicker(subscriptionTouchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-updates:
+			update := &cryptocompare.PriceList{}
+			update.Set(event.Pair, event.New, event.Display)
+
+			// the changes published in the meantime are sent along
+		collect:
+			for {
+				select {
+				case event := <-updates:
+					update.Set(event.Pair, event.New, event.Display)
+				default:
+					break collect
+				}
+			}
+
+			writeJSON(wsWriter, websocketMessage{
+				Type: messageUpdate,
+				Data: update,
+			})
+
+		case <-ticker.C:
+			if server.tracker != nil {
+				server.tracker.Touch(subscriber.subscribed())
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// queriedPairs returns every combination of the queried fsyms and tsyms.
+func queriedPairs(fsyms []string, tsyms []string) ([]cryptocompare.Pair, error) {
+	if len(fsyms) == 0 {
+		return nil, errFsymsEmpty
+	}
+
+	if len(tsyms) == 0 {
+		return nil, errTsymsEmpty
+	}
+
+	pairs := []cryptocompare.Pair{}
+	for _, fsym := range fsyms {
+		for _, tsym := range tsyms {
+			pairs = append(pairs, cryptocompare.Pair{Fsym: fsym, Tsym: tsym})
+		}
+	}
+
+	return pairs, nil
+}
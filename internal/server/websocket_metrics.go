@@ -0,0 +1,83 @@
+package server
+
+import (
+	"sync/atomic"
+)
+
+// websocketMetrics counts the websocket connections and the reasons they
+// are closed for, the counters are updated atomically.
+type websocketMetrics struct {
+	connections   int64
+	accepted      int64
+	rejected      int64
+	queued        int64
+	pings         int64
+	idleTimeouts  int64
+	oversized     int64
+	slowConsumers int64
+}
+
+// WebsocketStatus is a snapshot of the websocket metrics.
+type WebsocketStatus struct {
+	// Connections is a number of the open connections.
+	Connections int64 `json:"connections"`
+
+	// Accepted and Rejected are numbers of the connections accepted and
+	// rejected due to the connection limit since start.
+	Accepted int64 `json:"accepted"`
+	Rejected int64 `json:"rejected"`
+
+	// Queued is a number of the messages waiting to be sent to the clients.
+	Queued int64 `json:"queued"`
+
+	// Pings is a number of the keepalive pings sent.
+	Pings int64 `json:"pings"`
+
+	// IdleTimeouts, OversizedMessages and SlowConsumers are numbers of the
+	// connections closed because the client was idle for too long, sent a
+	// too large message or didn't keep up with the outbound messages.
+	IdleTimeouts      int64 `json:"idle_timeouts"`
+	OversizedMessages int64 `json:"oversized_messages"`
+	SlowConsumers     int64 `json:"slow_consumers"`
+}
+
+// WebsocketStatus returns the current websocket metrics.
+func (server *Server) WebsocketStatus() WebsocketStatus {
+	metrics := server.websocketMetrics
+
+	return WebsocketStatus{
+		Connections:       atomic.LoadInt64(&metrics.connections),
+		Accepted:          atomic.LoadInt64(&metrics.accepted),
+		Rejected:          atomic.LoadInt64(&metrics.rejected),
+		Queued:            atomic.LoadInt64(&metrics.queued),
+		Pings:             atomic.LoadInt64(&metrics.pings),
+		IdleTimeouts:      atomic.LoadInt64(&metrics.idleTimeouts),
+		OversizedMessages: atomic.LoadInt64(&metrics.oversized),
+		SlowConsumers:     atomic.LoadInt64(&metrics.slowConsumers),
+	}
+}
+
+// acquireConnection returns false if the limit of the websocket connections
+// is reached, otherwise the connection should be released once it's closed
+// and counted by acceptConnection once it's upgraded.
+func (server *Server) acquireConnection(limit int) bool {
+	metrics := server.websocketMetrics
+
+	connections := atomic.AddInt64(&metrics.connections, 1)
+	if limit > 0 && connections > int64(limit) {
+		atomic.AddInt64(&metrics.connections, -1)
+		atomic.AddInt64(&metrics.rejected, 1)
+
+		return false
+	}
+
+	return true
+}
+
+func (server *Server) acceptConnection() {
+	atomic.AddInt64(&server.websocketMetrics.accepted, 1)
+}
+
+func (server *Server) releaseConnection() {
+	atomic.AddInt64(&server.websocketMetrics.connections, -1)
+}
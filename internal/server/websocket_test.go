@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/events"
+	"github.com/stretchr/testify/assert"
+)
+
+type testMessage struct {
+	Type string                  `json:"type"`
+	Data cryptocompare.PriceList `json:"data"`
+}
+
+func TestServer_handleWebsocket_PushesSubscribedPairs(t *testing.T) {
+	test := assert.New(t)
+
+	server, storage, _ := newTestServer(t)
+
+	// the prices written by the server are published to the bus
+	server.bus = events.NewBus()
+	server.cache = events.NewCache(storage, server.bus)
+
+	err := server.cache.Write(
+		context.Background(),
+		time.Now(),
+		"BTC",
+		"USD",
+		cryptocompare.RawPrice{Price: 1},
+		cryptocompare.DisplayPrice{Price: "1"},
+	)
+	test.NoError(err)
+
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	connection, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(httpServer.URL, "http")+apiPath,
+		nil,
+	)
+	if !test.NoError(err) {
+		return
+	}
+
+	defer connection.Close()
+
+	read := func() testMessage {
+		var message testMessage
+
+		connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+		test.NoError(connection.ReadJSON(&message))
+
+		return message
+	}
+
+	test.NoError(connection.WriteJSON(websocketQuery{
+		Action: actionSubscribe,
+		Fsyms:  []string{"BTC"},
+		Tsyms:  []string{"USD"},
+	}))
+
+	snapshot := read()
+	test.Equal(messageSnapshot, snapshot.Type)
+	test.Equal(1.0, snapshot.Data.Raw["BTC"]["USD"].Price)
+
+	// the plain queries are answered as is
+	test.NoError(connection.WriteJSON(websocketQuery{
+		Fsyms: []string{"BTC"},
+		Tsyms: []string{"USD"},
+	}))
+
+	var answer priceResponse
+	connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	test.NoError(connection.ReadJSON(&answer))
+	test.Equal(1.0, answer.Raw["BTC"]["USD"].Price)
+
+	write := func(fsym string, price float64) {
+		err := server.cache.Write(
+			context.Background(),
+			time.Now(),
+			fsym,
+			"USD",
+			cryptocompare.RawPrice{Price: price},
+			cryptocompare.DisplayPrice{},
+		)
+		test.NoError(err)
+	}
+
+	// neither unchanged nor unsubscribed prices are pushed
+	write("BTC", 1)
+	write("ETH", 3)
+	write("BTC", 2)
+
+	update := read()
+	test.Equal(messageUpdate, update.Type)
+	test.Equal(2.0, update.Data.Raw["BTC"]["USD"].Price)
+	test.NotContains(update.Data.Raw, "ETH")
+
+	test.NoError(connection.WriteJSON(websocketQuery{
+		Action: actionUnsubscribe,
+		Fsyms:  []string{"BTC"},
+		Tsyms:  []string{"USD"},
+	}))
+	test.Equal(messageUnsubscribed, read().Type)
+
+	write("BTC", 3)
+
+	// nothing is pushed once unsubscribed, the next message is the answer
+	test.NoError(connection.WriteJSON(websocketQuery{Action: "blah"}))
+
+	var failure map[string]string
+	connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	test.NoError(connection.ReadJSON(&failure))
+	test.Contains(failure["error"], "unknown action")
+}
+
+func TestServer_handleWebsocket_EnforcesLimits(t *testing.T) {
+	test := assert.New(t)
+
+	server, _, _ := newTestServer(t)
+
+	settings := server.Settings()
+	settings.WebsocketIdleTimeout = 1
+	settings.WebsocketMaxMessageSize = 64
+	settings.WebsocketMaxConnections = 1
+	test.NoError(server.Reload(settings))
+
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	dial := func() (*websocket.Conn, int, error) {
+		connection, response, err := websocket.DefaultDialer.Dial(
+			"ws"+strings.TrimPrefix(httpServer.URL, "http")+apiPath,
+			nil,
+		)
+		if response == nil {
+			return connection, 0, err
+		}
+
+		return connection, response.StatusCode, err
+	}
+
+	// the closed connections are released in the background
+	waitClosed := func() {
+		for server.WebsocketStatus().Connections > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	connection, _, err := dial()
+	if !test.NoError(err) {
+		return
+	}
+
+	_, code, err := dial()
+	test.Error(err)
+	test.Equal(http.StatusServiceUnavailable, code)
+
+	test.NoError(connection.WriteMessage(
+		websocket.TextMessage,
+		[]byte(`{"fsyms": ["`+strings.Repeat("BTC", 64)+`"]}`),
+	))
+
+	connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = connection.ReadMessage()
+	test.Error(err)
+	connection.Close()
+	waitClosed()
+
+	// the client sending nothing is disconnected once it's idle
+	connection, _, err = dial()
+	if !test.NoError(err) {
+		return
+	}
+
+	defer connection.Close()
+
+	connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = connection.ReadMessage()
+	test.Error(err)
+	waitClosed()
+
+	// the request that can't be upgraded is not accepted
+	plain, err := http.Get(httpServer.URL + apiPath)
+	if test.NoError(err) {
+		plain.Body.Close()
+		test.Equal(http.StatusBadRequest, plain.StatusCode)
+	}
+
+	waitClosed()
+
+	status := server.WebsocketStatus()
+	test.EqualValues(2, status.Accepted)
+	test.EqualValues(1, status.Rejected)
+	test.EqualValues(1, status.OversizedMessages)
+	test.EqualValues(1, status.IdleTimeouts)
+}
+
+func TestWebsocketWriter_Write_DisconnectsSlowConsumer(t *testing.T) {
+	test := assert.New(t)
+
+	metrics := &websocketMetrics{}
+	writer := newWebsocketWriter(nil, metrics, 1)
+
+	_, err := writer.Write([]byte("first"))
+	test.NoError(err)
+
+	_, err = writer.Write([]byte("second"))
+	test.Equal(errSlowConsumer, err)
+
+	select {
+	case <-writer.overflowed:
+	default:
+		test.Fail("the overflow is not reported")
+	}
+
+	test.EqualValues(1, metrics.queued)
+
+	writer.discard()
+	test.EqualValues(0, metrics.queued)
+}
+
+func TestServer_handleQuery_DoesNotSubscribeIfSnapshotFails(t *testing.T) {
+	test := assert.New(t)
+
+	server, _, client := newTestServer(t)
+	client.err = errors.New("upstream is down")
+
+	btc := cryptocompare.Pair{Fsym: "BTC", Tsym: "USD"}
+	eth := cryptocompare.Pair{Fsym: "ETH", Tsym: "USD"}
+
+	subscriber := newSubscriber()
+	subscriber.subscribe([]cryptocompare.Pair{eth})
+
+	err := server.handleQuery(
+		context.Background(),
+		newWebsocketWriter(nil, server.websocketMetrics, 1),
+		subscriber,
+		websocketQuery{
+			Action: actionSubscribe,
+			Fsyms:  []string{"BTC", "ETH"},
+			Tsyms:  []string{"USD"},
+		},
+	)
+	test.Error(err)
+
+	// the pairs subscribed before are kept
+	test.Equal([]cryptocompare.Pair{eth}, subscriber.subscribed())
+	test.False(subscriber.wants(events.Event{
+		Pair: btc,
+		New:  cryptocompare.RawPrice{Price: 1},
+	}))
+}
@@ -1,18 +1,165 @@
 package server
 
-import "github.com/gorilla/websocket"
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/reconquest/pkg/log"
+)
+
+var errSlowConsumer = errors.New("websocket outbound queue is full")
+
+// websocketWriter queues every Write call as a single text message, the
+// messages are sent by serve, so concurrent writers are not blocked by a slow
+// client. The client is disconnected once the queue is full.
 type websocketWriter struct {
 	connection *websocket.Conn
+	metrics    *websocketMetrics
+
+	queue chan []byte
+
+	// overflowed is closed once a message doesn't fit the queue.
+	overflowed chan struct{}
+	overflow   sync.Once
 }
 
-func (writer websocketWriter) Write(data []byte) (int, error) {
-	underlying, err := writer.connection.NextWriter(websocket.TextMessage)
-	if err != nil {
-		return 0, err
+func newWebsocketWriter(
+	connection *websocket.Conn,
+	metrics *websocketMetrics,
+	queueSize int,
+) *websocketWriter {
+	return &websocketWriter{
+		connection: connection,
+		metrics:    metrics,
+		queue:      make(chan []byte, queueSize),
+		overflowed: make(chan struct{}),
+	}
+}
+
+func (writer *websocketWriter) Write(data []byte) (int, error) {
+	// the caller may reuse the given slice once Write returns
+	message := make([]byte, len(data))
+	copy(message, data)
+
+	select {
+	case writer.queue <- message:
+		atomic.AddInt64(&writer.metrics.queued, 1)
+
+		return len(data), nil
+	default:
+		writer.overflow.Do(func() {
+			close(writer.overflowed)
+		})
+
+		return 0, errSlowConsumer
+	}
+}
+
+// serve sends the queued messages and the keepalive pings until the given
+// context is cancelled or the client fails to keep up, every write should be
+// done in time if the idle timeout is specified.
+func (writer *websocketWriter) serve(
+	ctx context.Context,
+	pingInterval time.Duration,
+	idleTimeout time.Duration,
+) {
+	var pings <-chan time.Time
+	if pingInterval > 0 {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+
+		pings = ticker.C
+	}
+
+	deadline := func() time.Time {
+		if idleTimeout > 0 {
+			return time.Now().Add(idleTimeout)
+		}
+
+		return time.Time{}
 	}
 
-	defer underlying.Close()
+	for {
+		select {
+		case message := <-writer.queue:
+			atomic.AddInt64(&writer.metrics.queued, -1)
 
-	return underlying.Write(data)
+			err := writer.connection.SetWriteDeadline(deadline())
+			if err != nil {
+				return
+			}
+
+			err = writer.connection.WriteMessage(websocket.TextMessage, message)
+			if err != nil {
+				writer.closed(err)
+				return
+			}
+
+		case <-pings:
+			err := writer.connection.WriteControl(
+				websocket.PingMessage,
+				nil,
+				deadline(),
+			)
+			if err != nil {
+				writer.closed(err)
+				return
+			}
+
+			atomic.AddInt64(&writer.metrics.pings, 1)
+
+		case <-writer.overflowed:
+			atomic.AddInt64(&writer.metrics.slowConsumers, 1)
+
+			log.Warningf(
+				nil,
+				"websocket: disconnecting the client not keeping up with %d "+
+					"queued messages",
+				cap(writer.queue),
+			)
+
+			writer.connection.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(
+					websocket.CloseTryAgainLater,
+					"slow consumer",
+				),
+				time.Now().Add(time.Second),
+			)
+
+			return
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// closed counts the connection closed due to the given write error if the
+// client didn't receive a message in time.
+func (writer *websocketWriter) closed(err error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		atomic.AddInt64(&writer.metrics.idleTimeouts, 1)
+
+		log.Debugf(nil, "websocket: disconnecting the client not reading")
+	}
+}
+
+// discard forgets the messages left in the queue once the connection is
+// closed, so they are not counted as queued.
+func (writer *websocketWriter) discard() {
+	for {
+		select {
+		case <-writer.queue:
+			atomic.AddInt64(&writer.metrics.queued, -1)
+		default:
+			return
+		}
+	}
 }
@@ -4,10 +4,66 @@ import (
 	"encoding/json"
 	"io"
 
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
 )
 
+// priceResponse is a price list with per-pair details, the details are
+// omitted when empty, so the response is the same as cryptocompare's one.
+type priceResponse struct {
+	*cryptocompare.PriceList
+
+	// Errors describes the requested pairs which prices are not available.
+	Errors map[string]map[string]string `json:"ERRORS,omitempty"`
+
+	// Meta describes the age of every pair, it's present only if some of the
+	// prices are stale.
+	Meta map[string]map[string]pairMeta `json:"META,omitempty"`
+}
+
+// pairMeta describes how old a price is.
+type pairMeta struct {
+	// Age is a number of seconds since the price was received from the
+	// upstream.
+	Age int64 `json:"AGE"`
+
+	// Stale is true if the price has expired, but is served since the
+	// upstream is not available.
+	Stale bool `json:"STALE"`
+}
+
+func (response *priceResponse) addMeta(
+	pair cryptocompare.Pair,
+	meta pairMeta,
+) {
+	if response.Meta == nil {
+		response.Meta = map[string]map[string]pairMeta{}
+	}
+
+	if _, ok := response.Meta[pair.Fsym]; !ok {
+		response.Meta[pair.Fsym] = map[string]pairMeta{}
+	}
+
+	response.Meta[pair.Fsym][pair.Tsym] = meta
+}
+
+func (response *priceResponse) addError(
+	pair cryptocompare.Pair,
+	reason string,
+) {
+	if response.Errors == nil {
+		response.Errors = map[string]map[string]string{}
+	}
+
+	if _, ok := response.Errors[pair.Fsym]; !ok {
+		response.Errors[pair.Fsym] = map[string]string{}
+	}
+
+	response.Errors[pair.Fsym][pair.Tsym] = reason
+}
+
 func writeJSON(writer io.Writer, msg interface{}) {
 	err := json.NewEncoder(writer).Encode(msg)
 	if err != nil {
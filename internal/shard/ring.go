@@ -0,0 +1,75 @@
+package shard
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+const (
+	// ringReplicas is a number of points every member has on the ring, the
+	// more points, the more even the keys are spread.
+	ringReplicas = 128
+)
+
+// Ring spreads keys among members by consistent hashing: a key belongs to
+// the member owning the first point of the ring following the key's hash.
+// Adding or removing a member only moves the keys of that member.
+type Ring struct {
+	points  []uint32
+	members map[uint32]string
+}
+
+// NewRing returns a ring of the given members.
+func NewRing(members []string) *Ring {
+	ring := &Ring{
+		members: map[uint32]string{},
+	}
+
+	for _, member := range members {
+		for i := 0; i < ringReplicas; i++ {
+			point := hash(member + "#" + strconv.Itoa(i))
+
+			// a collision is resolved in favor of the least member, so
+			// every instance builds the same ring
+			if owner, ok := ring.members[point]; ok && owner < member {
+				continue
+			}
+
+			if _, ok := ring.members[point]; !ok {
+				ring.points = append(ring.points, point)
+			}
+
+			ring.members[point] = member
+		}
+	}
+
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i] < ring.points[j]
+	})
+
+	return ring
+}
+
+// Owner returns the member the given key belongs to, empty if the ring has
+// no members.
+func (ring *Ring) Owner(key string) string {
+	if len(ring.points) == 0 {
+		return ""
+	}
+
+	point := hash(key)
+
+	i := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i] >= point
+	})
+	if i == len(ring.points) {
+		i = 0
+	}
+
+	return ring.members[ring.points[i]]
+}
+
+func hash(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
@@ -0,0 +1,221 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cache"
+	"github.com/reconquest/pkg/log"
+)
+
+const (
+	// announceFactor is a number of announcements made within the member
+	// TTL, so a single failed announcement doesn't drop the member.
+	announceFactor = 3
+)
+
+// Status describes the members sharing the work.
+type Status struct {
+	Member  string   `json:"member"`
+	Members []string `json:"members"`
+}
+
+// Membership announces the instance in the membership list stored in the
+// cache storage and spreads keys among the listed members (see Ring). Every
+// member builds the same ring, so every key belongs to exactly one member
+// once the members have seen the same list.
+type Membership struct {
+	storage cache.Membership
+	name    string
+	ttl     time.Duration
+
+	// onChange is called once the members have changed, so the keys have
+	// been rebalanced.
+	onChange func()
+
+	members []string
+	ring    *Ring
+
+	// announcedAt is a time of the last successful announcement.
+	announcedAt time.Time
+	mutex       sync.Mutex
+
+	// syncing is held during a sync, so the member is not announced again
+	// once it's deleted by Close.
+	syncing sync.Mutex
+
+	context context.Context
+	cancel  context.CancelFunc
+}
+
+// New instance of Membership announcing the member of the given name, the
+// ttl is a duration of time (seconds) the member is listed for without
+// announcing itself again.
+func New(
+	storage cache.Membership,
+	name string,
+	ttl int,
+	onChange func(),
+) (*Membership, error) {
+	if name == "" {
+		return nil, fmt.Errorf("member name should not be empty")
+	}
+
+	if ttl <= 0 {
+		return nil, fmt.Errorf("member ttl should be positive, but got %d", ttl)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Membership{
+		storage:  storage,
+		name:     name,
+		ttl:      time.Duration(ttl) * time.Second,
+		onChange: onChange,
+		ring:     NewRing(nil),
+		context:  ctx,
+		cancel:   cancel,
+	}, nil
+}
+
+// Serve announces the member and follows the membership list until the
+// membership is closed.
+func (membership *Membership) Serve() {
+	log.Infof(nil, "shard: joining the membership as %s", membership.name)
+
+	for {
+		membership.sync()
+
+		select {
+		case <-time.After(membership.ttl / announceFactor):
+			//
+		case <-membership.context.Done():
+			return
+		}
+	}
+}
+
+// sync announces the member and rebuilds the ring if the members have
+// changed.
+func (membership *Membership) sync() {
+	membership.syncing.Lock()
+	defer membership.syncing.Unlock()
+
+	if membership.context.Err() != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(
+		membership.context,
+		membership.ttl/announceFactor,
+	)
+	defer cancel()
+
+	now := time.Now()
+
+	err := membership.storage.WriteMember(
+		ctx,
+		membership.name,
+		now,
+		membership.ttl,
+	)
+	if err == nil {
+		membership.mutex.Lock()
+		membership.announcedAt = now
+		membership.mutex.Unlock()
+	} else if membership.context.Err() == nil {
+		log.Errorf(err, "shard: unable to announce the member")
+	}
+
+	members, err := membership.storage.ReadMembers(ctx, now)
+	if err != nil {
+		if membership.context.Err() != nil {
+			return
+		}
+
+		log.Errorf(err, "shard: unable to read the members")
+
+		// the other members drop this one once its announcement expires,
+		// so it gives its share up as well
+		membership.mutex.Lock()
+		expired := now.Sub(membership.announcedAt) > membership.ttl
+		membership.mutex.Unlock()
+
+		if expired {
+			membership.change(nil)
+		}
+
+		return
+	}
+
+	membership.change(members)
+}
+
+// change rebuilds the ring of the given members and tells about it if the
+// members have changed.
+func (membership *Membership) change(members []string) {
+	membership.mutex.Lock()
+	if reflect.DeepEqual(membership.members, members) {
+		membership.mutex.Unlock()
+		return
+	}
+
+	membership.members = members
+	membership.ring = NewRing(members)
+	membership.mutex.Unlock()
+
+	log.Infof(
+		nil,
+		"shard: the pairs are rebalanced among %d member(s): %s",
+		len(members),
+		strings.Join(members, ", "),
+	)
+
+	if membership.onChange != nil {
+		membership.onChange()
+	}
+}
+
+// Owns returns true if the given key belongs to this member. No key does
+// until the members are read for the first time.
+func (membership *Membership) Owns(key string) bool {
+	membership.mutex.Lock()
+	defer membership.mutex.Unlock()
+
+	return membership.ring.Owner(key) == membership.name
+}
+
+// Status returns the members sharing the work.
+func (membership *Membership) Status() Status {
+	membership.mutex.Lock()
+	defer membership.mutex.Unlock()
+
+	return Status{
+		Member:  membership.name,
+		Members: append([]string{}, membership.members...),
+	}
+}
+
+// Close leaves the membership, so the rest members take the share of this
+// one over without waiting for its announcement to expire.
+func (membership *Membership) Close() {
+	membership.cancel()
+
+	membership.syncing.Lock()
+	defer membership.syncing.Unlock()
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		membership.ttl/announceFactor,
+	)
+	defer cancel()
+
+	err := membership.storage.DeleteMember(ctx, membership.name)
+	if err != nil {
+		log.Errorf(err, "shard: unable to leave the membership")
+	}
+}
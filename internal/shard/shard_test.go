@@ -0,0 +1,74 @@
+package shard
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing_Owner_MovesKeysOfChangedMemberOnly(t *testing.T) {
+	test := assert.New(t)
+
+	before := NewRing([]string{"a", "b"})
+	after := NewRing([]string{"a", "b", "c"})
+
+	owned := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		key := "KEY" + strconv.Itoa(i) + "/USD"
+
+		owner := after.Owner(key)
+		owned[owner]++
+
+		if owner != "c" {
+			test.Equal(before.Owner(key), owner, key)
+		}
+	}
+
+	// every member has a fair share
+	for _, member := range []string{"a", "b", "c"} {
+		test.Greater(owned[member], 200, member)
+	}
+
+	test.Equal("", NewRing(nil).Owner("BTC/USD"))
+}
+
+func TestMembership_sync_SplitsKeysAmongMembers(t *testing.T) {
+	test := assert.New(t)
+
+	storage, err := cache.New(cache.BackendMemory, "", "", "", "", "")
+	test.NoError(err)
+	test.NoError(storage.Boot())
+
+	changes := 0
+
+	first, err := New(storage, "first", 60, func() {
+		changes++
+	})
+	test.NoError(err)
+
+	second, err := New(storage, "second", 60, nil)
+	test.NoError(err)
+
+	test.False(first.Owns("BTC/USD"))
+
+	first.sync()
+	test.True(first.Owns("BTC/USD"))
+
+	second.sync()
+	first.sync()
+	test.Equal([]string{"first", "second"}, first.Status().Members)
+
+	for i := 0; i < 100; i++ {
+		key := "KEY" + strconv.Itoa(i) + "/USD"
+
+		test.NotEqual(first.Owns(key), second.Owns(key), key)
+	}
+
+	// the share of the gone member is taken over
+	second.Close()
+	first.sync()
+	test.True(first.Owns("BTC/USD"))
+	test.Equal(3, changes)
+}
@@ -0,0 +1,128 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+)
+
+// Add starts refreshing the given pairs until they are removed, the pairs are
+// stored in the watchlist, so they survive restarts.
+func (updater *Updater) Add(
+	ctx context.Context,
+	pairs []cryptocompare.Pair,
+) error {
+	now := time.Now()
+
+	for _, pair := range pairs {
+		err := updater.cache.WriteWatch(
+			ctx,
+			now,
+			pair.Fsym,
+			pair.Tsym,
+			SourceAdmin,
+		)
+		if err != nil {
+			return karma.Format(err, "write %s to watchlist", pair)
+		}
+	}
+
+	schedules := updater.schedules()
+
+	updater.mutex.Lock()
+	for _, pair := range pairs {
+		updater.admin[pair] = true
+	}
+	updater.mutex.Unlock()
+
+	updater.reschedule(schedules)
+
+	log.Infof(nil, "updater: added %d pair(s) by admin", len(pairs))
+
+	return nil
+}
+
+// Remove stops refreshing the given pairs added by admins or tracked due to
+// demand. The configured pairs can't be removed, the configuration should be
+// changed instead.
+func (updater *Updater) Remove(
+	ctx context.Context,
+	pairs []cryptocompare.Pair,
+) error {
+	updater.mutex.Lock()
+	for _, pair := range pairs {
+		if _, ok := updater.intervals[pair]; ok {
+			updater.mutex.Unlock()
+
+			return fmt.Errorf(
+				"%s is configured and can't be removed at runtime",
+				pair,
+			)
+		}
+	}
+	updater.mutex.Unlock()
+
+	for _, pair := range pairs {
+		for _, source := range []string{SourceAdmin, SourceDemand} {
+			err := updater.cache.DeleteWatch(
+				ctx,
+				pair.Fsym,
+				pair.Tsym,
+				source,
+			)
+			if err != nil {
+				return karma.Format(err, "delete %s from watchlist", pair)
+			}
+		}
+	}
+
+	schedules := updater.schedules()
+
+	updater.mutex.Lock()
+	for _, pair := range pairs {
+		delete(updater.admin, pair)
+		delete(updater.demand, pair)
+		delete(updater.states, pair)
+	}
+	updater.mutex.Unlock()
+
+	updater.reschedule(schedules)
+
+	log.Infof(nil, "updater: removed %d pair(s) by admin", len(pairs))
+
+	return nil
+}
+
+// Refresh immediately updates the given pairs regardless of their failures,
+// all pairs are updated if none are given. Only the pairs refreshed by the
+// updater can be given.
+func (updater *Updater) Refresh(
+	ctx context.Context,
+	pairs []cryptocompare.Pair,
+) error {
+	updater.mutex.Lock()
+	if len(pairs) == 0 {
+		pairs = updater.pairs()
+	}
+
+	for _, pair := range pairs {
+		if !updater.tracks(pair) {
+			updater.mutex.Unlock()
+
+			return fmt.Errorf("%s is not refreshed by the updater", pair)
+		}
+	}
+	updater.mutex.Unlock()
+
+	// the rest pairs are refreshed by other instances
+	pairs = updater.owned(pairs)
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	return updater.refresh(ctx, pairs, time.Now())
+}
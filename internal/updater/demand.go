@@ -0,0 +1,300 @@
+package updater
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+)
+
+const (
+	// SourceConfig is a source of the pairs listed in the configuration.
+	SourceConfig = "config"
+
+	// SourceDemand is a source of the pairs tracked since they are requested
+	// by users.
+	SourceDemand = "demand"
+
+	// SourceAdmin is a source of the pairs added at runtime by admins.
+	SourceAdmin = "admin"
+)
+
+// demand describes a pair tracked since it's requested by users.
+type demand struct {
+	seenAt time.Time
+
+	// persistedAt is seenAt last written to the watchlist.
+	persistedAt time.Time
+}
+
+// Load restores the pairs added by admins and the pairs tracked due to demand
+// from the watchlist, so they survive restarts.
+func (updater *Updater) Load(ctx context.Context) error {
+	admin, demanded, err := updater.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Infof(
+		nil,
+		"updater: loaded %d pair(s) added by admins and "+
+			"%d pair(s) tracked due to demand",
+		admin,
+		demanded,
+	)
+
+	return nil
+}
+
+// load reads the watchlist: the pairs added by admins are replaced with the
+// listed ones, the pairs tracked due to demand are merged with the listed
+// ones. Returns the numbers of both.
+func (updater *Updater) load(ctx context.Context) (int, int, error) {
+	watches, err := updater.cache.ReadWatchlist(ctx)
+	if err != nil {
+		return 0, 0, karma.Format(err, "read watchlist")
+	}
+
+	schedules := updater.schedules()
+
+	updater.mutex.Lock()
+
+	admin := map[cryptocompare.Pair]bool{}
+	for _, watch := range watches {
+		pair := cryptocompare.Pair{
+			Fsym: watch.FromSymbol(),
+			Tsym: watch.ToSymbol(),
+		}
+
+		switch {
+		case watch.Source() == SourceAdmin:
+			admin[pair] = true
+
+		case watch.Source() == SourceDemand && updater.demandLimit > 0:
+			// the pair may have been requested from another instance
+			// since it was requested from this one
+			state, ok := updater.demand[pair]
+			if ok && !watch.SeenAt().After(state.seenAt) {
+				continue
+			}
+
+			updater.demand[pair] = &demand{
+				seenAt:      watch.SeenAt(),
+				persistedAt: watch.SeenAt(),
+			}
+		}
+	}
+
+	// the watchlist may list more pairs than allowed, e.g. once the limit is
+	// reduced
+	dropped := updater.trimDemand()
+
+	removed := updater.admin
+	updater.admin = admin
+
+	for pair := range removed {
+		if !updater.tracks(pair) {
+			delete(updater.states, pair)
+		}
+	}
+
+	for _, pair := range dropped {
+		if !updater.tracks(pair) {
+			delete(updater.states, pair)
+		}
+	}
+
+	loaded, demanded := len(updater.admin), len(updater.demand)
+
+	updater.mutex.Unlock()
+
+	for _, pair := range dropped {
+		err := updater.cache.DeleteWatch(
+			ctx,
+			pair.Fsym,
+			pair.Tsym,
+			SourceDemand,
+		)
+		if err != nil {
+			log.Errorf(err, "updater: unable to delete %s from watchlist", pair)
+		}
+	}
+
+	updater.reschedule(schedules)
+
+	return loaded, demanded, nil
+}
+
+// trimDemand stops tracking the least recently requested pairs above the
+// demand limit and returns them. It's expected to be called with the mutex
+// locked.
+func (updater *Updater) trimDemand() []cryptocompare.Pair {
+	excess := len(updater.demand) - updater.demandLimit
+	if excess <= 0 {
+		return nil
+	}
+
+	pairs := []cryptocompare.Pair{}
+	for pair := range updater.demand {
+		pairs = append(pairs, pair)
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		return updater.demand[pairs[i]].seenAt.Before(
+			updater.demand[pairs[j]].seenAt,
+		)
+	})
+
+	dropped := pairs[:excess]
+	for _, pair := range dropped {
+		log.Infof(
+			nil,
+			"updater: stopped tracking %s, the limit of %d pairs reached",
+			pair,
+			updater.demandLimit,
+		)
+
+		delete(updater.demand, pair)
+	}
+
+	return dropped
+}
+
+// Track starts tracking the given pairs requested by users, the pairs are
+// refreshed until they are not requested for the idle timeout.
+func (updater *Updater) Track(pairs []cryptocompare.Pair) {
+	now := time.Now()
+
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+
+	if updater.demandLimit == 0 {
+		return
+	}
+
+	for _, pair := range pairs {
+		if _, ok := updater.intervals[pair]; ok || updater.admin[pair] {
+			continue
+		}
+
+		if state, ok := updater.demand[pair]; ok {
+			state.seenAt = now
+			continue
+		}
+
+		if len(updater.demand) >= updater.demandLimit {
+			log.Warningf(
+				nil,
+				"updater: unable to track %s, the limit of %d pairs reached",
+				pair,
+				updater.demandLimit,
+			)
+
+			continue
+		}
+
+		log.Infof(nil, "updater: started tracking %s due to demand", pair)
+
+		updater.demand[pair] = &demand{seenAt: now}
+	}
+}
+
+// Touch marks the given pairs as requested by users, so the tracked ones are
+// not dropped.
+func (updater *Updater) Touch(pairs []cryptocompare.Pair) {
+	now := time.Now()
+
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+
+	for _, pair := range pairs {
+		if state, ok := updater.demand[pair]; ok {
+			state.seenAt = now
+		}
+	}
+}
+
+// tracksDemand returns true if tracking pairs due to demand is enabled.
+func (updater *Updater) tracksDemand() bool {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+
+	return updater.demandLimit > 0
+}
+
+// syncDemand drops the pairs not requested for the idle timeout and persists
+// the rest in the watchlist.
+func (updater *Updater) syncDemand(ctx context.Context) {
+	if !updater.tracksDemand() {
+		return
+	}
+
+	now := time.Now()
+
+	updater.mutex.Lock()
+
+	idleSince := now.Add(-updater.demandIdle)
+
+	idle := []cryptocompare.Pair{}
+	seen := map[cryptocompare.Pair]time.Time{}
+	for pair, state := range updater.demand {
+		if now.Sub(state.seenAt) > updater.demandIdle {
+			idle = append(idle, pair)
+
+			delete(updater.demand, pair)
+
+			// the pair may have been configured since it's tracked
+			if !updater.tracks(pair) {
+				delete(updater.states, pair)
+			}
+
+			continue
+		}
+
+		if !state.seenAt.Equal(state.persistedAt) {
+			seen[pair] = state.seenAt
+		}
+	}
+
+	updater.mutex.Unlock()
+
+	for _, pair := range idle {
+		log.Infof(nil, "updater: stopped tracking %s, it's idle", pair)
+
+		// the pair may have been requested from another instance sharing
+		// the watchlist since it was requested from this one
+		err := updater.cache.DeleteWatchSeenBefore(
+			ctx,
+			pair.Fsym,
+			pair.Tsym,
+			SourceDemand,
+			idleSince,
+		)
+		if err != nil {
+			log.Errorf(err, "updater: unable to delete %s from watchlist", pair)
+		}
+	}
+
+	for pair, seenAt := range seen {
+		err := updater.cache.WriteWatch(
+			ctx,
+			seenAt,
+			pair.Fsym,
+			pair.Tsym,
+			SourceDemand,
+		)
+		if err != nil {
+			log.Errorf(err, "updater: unable to write %s to watchlist", pair)
+			continue
+		}
+
+		updater.mutex.Lock()
+		if state, ok := updater.demand[pair]; ok {
+			state.persistedAt = seenAt
+		}
+		updater.mutex.Unlock()
+	}
+}
@@ -0,0 +1,136 @@
+package updater
+
+import (
+	"context"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/reconquest/pkg/log"
+)
+
+// Pause stops refreshing the pairs since another instance refreshes them.
+// The pairs requested by users are still tracked and persisted, so the other
+// instance refreshes them as well.
+func (updater *Updater) Pause() {
+	schedules := updater.schedules()
+
+	updater.mutex.Lock()
+	updater.paused = true
+	updater.shared = true
+	updater.mutex.Unlock()
+
+	updater.reschedule(schedules)
+
+	log.Infof(nil, "updater: paused, the pairs are refreshed by another instance")
+}
+
+// Resume starts refreshing the pairs again, the watchlist changed by other
+// instances is loaded and the pairs are updated right away in the
+// background.
+func (updater *Updater) Resume() {
+	updater.mutex.Lock()
+	updater.paused = false
+	timeout := updater.updateInterval
+	updater.mutex.Unlock()
+
+	log.Infof(nil, "updater: resumed, the pairs are refreshed by this instance")
+
+	go updater.catchUp(timeout)
+}
+
+// Shard limits the pairs refreshed by the updater to the ones the given
+// function reports as the share of this instance, the rest are refreshed by
+// other instances. The pairs requested by users are persisted, so the
+// instance owning them refreshes them.
+func (updater *Updater) Shard(owns func(cryptocompare.Pair) bool) {
+	schedules := updater.schedules()
+
+	updater.mutex.Lock()
+	updater.owns = owns
+	updater.shared = true
+	updater.mutex.Unlock()
+
+	updater.reschedule(schedules)
+}
+
+// Rebalance updates the pairs right away in the background since the share
+// of this instance has changed, the pairs gained from other instances may
+// not be refreshed for a while otherwise.
+func (updater *Updater) Rebalance() {
+	updater.mutex.Lock()
+	timeout := updater.updateInterval
+	updater.mutex.Unlock()
+
+	go updater.catchUp(timeout)
+}
+
+// catchUp loads the watchlist changed by other instances and updates the
+// pairs within the given timeout.
+func (updater *Updater) catchUp(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(updater.context, timeout)
+	defer cancel()
+
+	updater.syncWatchlist(ctx)
+
+	err := updater.Update(ctx)
+	if err != nil && updater.context.Err() == nil {
+		log.Errorf(err, "updater: unable to update the symbols data")
+	}
+}
+
+// owned returns the given pairs belonging to the share of this instance.
+func (updater *Updater) owned(
+	pairs []cryptocompare.Pair,
+) []cryptocompare.Pair {
+	updater.mutex.Lock()
+	owns := updater.owns
+	updater.mutex.Unlock()
+
+	if owns == nil {
+		return pairs
+	}
+
+	result := []cryptocompare.Pair{}
+	for _, pair := range pairs {
+		if owns(pair) {
+			result = append(result, pair)
+		}
+	}
+
+	return result
+}
+
+// Paused returns true if the updater is paused.
+func (updater *Updater) Paused() bool {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+
+	return updater.paused
+}
+
+// syncsWatchlist returns true if the watchlist shared with other instances
+// should be synced before an update of the given interval.
+func (updater *Updater) syncsWatchlist(interval time.Duration) bool {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+
+	return updater.shared && !updater.paused &&
+		interval == updater.updateInterval
+}
+
+// syncWatchlist loads the pairs added or requested on other instances.
+func (updater *Updater) syncWatchlist(ctx context.Context) {
+	admin, demanded, err := updater.load(ctx)
+	if err != nil {
+		log.Errorf(err, "updater: unable to sync the watchlist")
+		return
+	}
+
+	log.Debugf(
+		nil,
+		"updater: synced %d pair(s) added by admins and "+
+			"%d pair(s) tracked due to demand",
+		admin,
+		demanded,
+	)
+}
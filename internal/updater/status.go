@@ -0,0 +1,130 @@
+package updater
+
+import (
+	"sort"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+)
+
+const (
+	// maxBackoffFactor limits the backoff of a failing pair to the given
+	// number of update intervals.
+	maxBackoffFactor = 32
+)
+
+// PairStatus describes the outcome of the recent updates of a pair.
+type PairStatus struct {
+	Fsym        string     `json:"fsym"`
+	Tsym        string     `json:"tsym"`
+	Source      string     `json:"source"`
+	Group       string     `json:"group,omitempty"`
+	Interval    int        `json:"interval"`
+	TTL         int        `json:"ttl,omitempty"`
+	SeenAt      *time.Time `json:"seen_at,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	Failures    int        `json:"failures"`
+	RetryAt     *time.Time `json:"retry_at,omitempty"`
+}
+
+type pairState struct {
+	lastSuccess time.Time
+	lastError   error
+	lastErrorAt time.Time
+	failures    int
+	retryAt     time.Time
+}
+
+func (state *pairState) succeed(at time.Time) {
+	state.lastSuccess = at
+	state.failures = 0
+	state.retryAt = time.Time{}
+}
+
+// fail records the failure and postpones the next attempt, the delay doubles
+// with every consecutive failure.
+func (state *pairState) fail(at time.Time, err error, interval time.Duration) {
+	state.lastError = err
+	state.lastErrorAt = at
+	state.failures++
+
+	factor := 1 << (state.failures - 1)
+	if factor > maxBackoffFactor || factor <= 0 {
+		factor = maxBackoffFactor
+	}
+
+	state.retryAt = at.Add(time.Duration(factor) * interval)
+}
+
+// Status returns the status of every pair the updater refreshes.
+func (updater *Updater) Status() []PairStatus {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+
+	statuses := []PairStatus{}
+	for _, pair := range updater.pairs() {
+		state := updater.state(pair)
+
+		status := PairStatus{
+			Fsym:     pair.Fsym,
+			Tsym:     pair.Tsym,
+			Source:   SourceConfig,
+			Group:    updater.groups[pair],
+			Interval: int(updater.interval(pair).Seconds()),
+			TTL:      updater.ttls[pair],
+			Failures: state.failures,
+		}
+
+		_, configured := updater.intervals[pair]
+		switch demand, demanded := updater.demand[pair]; {
+		case configured:
+			//
+		case updater.admin[pair]:
+			status.Source = SourceAdmin
+		case demanded:
+			status.Source = SourceDemand
+			status.SeenAt = timePointer(demand.seenAt)
+		}
+
+		if !state.lastSuccess.IsZero() {
+			status.LastSuccess = timePointer(state.lastSuccess)
+		}
+
+		if state.lastError != nil {
+			status.LastError = state.lastError.Error()
+			status.LastErrorAt = timePointer(state.lastErrorAt)
+		}
+
+		if !state.retryAt.IsZero() {
+			status.RetryAt = timePointer(state.retryAt)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Fsym != statuses[j].Fsym {
+			return statuses[i].Fsym < statuses[j].Fsym
+		}
+
+		return statuses[i].Tsym < statuses[j].Tsym
+	})
+
+	return statuses
+}
+
+func (updater *Updater) state(pair cryptocompare.Pair) *pairState {
+	state, ok := updater.states[pair]
+	if !ok {
+		state = &pairState{}
+		updater.states[pair] = state
+	}
+
+	return state
+}
+
+func timePointer(value time.Time) *time.Time {
+	return &value
+}
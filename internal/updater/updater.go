@@ -3,140 +3,718 @@ package updater
 import (
 	"context"
 	"fmt"
-	"strings"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/kovetskiy/cryptocompare-proxyd/internal/cache"
 	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/events"
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
 )
 
+const (
+	// jitterFactor is a maximum share of an interval the interval is
+	// randomized by.
+	jitterFactor = 0.1
+)
+
 // Updater has only one function — to update the entries in the database by the
-// given list of fsyms/tsyms.
+// given groups of pairs.
+//
+// Pairs are updated independently: a pair missing in the upstream response
+// doesn't prevent the rest pairs from being written, it's retried later with
+// a backoff instead.
+//
+// Besides the configured pairs, the updater refreshes pairs requested by
+// users (see Track) until they are idle.
+//
+// Several instances sharing the cache storage are expected to either elect a
+// single one refreshing the pairs, the rest are paused (see Pause), or to
+// split the pairs among themselves (see Shard).
 type Updater struct {
 	client cryptocompare.Client
 	cache  cache.Cache
 
-	fsyms []string
-	tsyms []string
+	// concurrency is a maximum number of upstream requests made at once to
+	// update the pairs.
+	concurrency int
+
+	// configured are the pairs of all groups in the configured order,
+	// intervals, ttls and groups describe the group every configured pair
+	// belongs to.
+	configured []cryptocompare.Pair
+	intervals  map[cryptocompare.Pair]time.Duration
+	ttls       map[cryptocompare.Pair]int
+	groups     map[cryptocompare.Pair]string
+
+	// updateInterval is used for the groups without an interval and the
+	// pairs tracked due to demand.
+	updateInterval time.Duration
+
+	// admin are the pairs added at runtime by admins, they are refreshed
+	// with the updater's update interval.
+	admin map[cryptocompare.Pair]bool
+
+	// demandLimit is a maximum number of pairs tracked due to demand, zero
+	// disables tracking, demandIdle is a duration of time a pair is tracked
+	// for since it was requested last time.
+	demand      map[cryptocompare.Pair]*demand
+	demandLimit int
+	demandIdle  time.Duration
+
+	// paused is true while another instance refreshes the pairs, shared is
+	// true if the watchlist is shared with other instances, so it's synced
+	// on every update of the pairs tracked due to demand.
+	paused bool
+	shared bool
 
-	updateInterval int
+	// owns returns true if the pair belongs to the share of this instance,
+	// every pair does if it's nil.
+	owns func(cryptocompare.Pair) bool
 
-	done chan struct{}
+	states map[cryptocompare.Pair]*pairState
+	mutex  sync.Mutex
+
+	// reloaded signals Serve to restart the schedules.
+	reloaded chan struct{}
+
+	context context.Context
+	cancel  context.CancelFunc
+}
+
+// Group is a tier of pairs refreshed with the same interval.
+type Group struct {
+	// Name of the group, it's shown in the status.
+	Name string
+
+	// Interval is a duration of time (seconds) between updates of the
+	// pairs, the updater's update interval is used if it's zero.
+	Interval int
+
+	// TTL is a duration of time (seconds) the cached prices of the pairs
+	// are served for, the server's TTL is used if it's zero.
+	TTL int
+
+	Pairs []cryptocompare.Pair
+}
+
+// CrossGroup returns a group of every combination of the given fsyms and
+// tsyms.
+func CrossGroup(name string, fsyms []string, tsyms []string) Group {
+	group := Group{Name: name}
+	for _, fsym := range fsyms {
+		for _, tsym := range tsyms {
+			group.Pairs = append(
+				group.Pairs,
+				cryptocompare.Pair{Fsym: fsym, Tsym: tsym},
+			)
+		}
+	}
+
+	return group
 }
 
 // New instance of Updater.
+//
+// A pair listed in several groups is refreshed with the shortest interval of
+// them.
 func New(
 	client cryptocompare.Client,
+	concurrency int,
 	cache cache.Cache,
-	fsyms []string,
-	tsyms []string,
+	groups []Group,
 	updateInterval int,
+	demandLimit int,
+	demandIdle int,
 ) (*Updater, error) {
-	return &Updater{
-		client:         client,
-		cache:          cache,
-		fsyms:          fsyms,
-		tsyms:          tsyms,
-		updateInterval: updateInterval,
-		done:           make(chan struct{}),
-	}, nil
+	ctx, cancel := context.WithCancel(context.Background())
+
+	updater := &Updater{
+		client:      client,
+		concurrency: concurrency,
+		cache:       cache,
+		admin:       map[cryptocompare.Pair]bool{},
+		demand:      map[cryptocompare.Pair]*demand{},
+		states:      map[cryptocompare.Pair]*pairState{},
+		reloaded:    make(chan struct{}, 1),
+		context:     ctx,
+		cancel:      cancel,
+	}
+
+	err := updater.configure(groups, updateInterval, demandLimit, demandIdle)
+	if err != nil {
+		cancel()
+
+		return nil, err
+	}
+
+	return updater, nil
+}
+
+// Reload applies the given groups and settings (see New) to the running
+// updater, the current ones are kept if the given ones are invalid. The
+// schedules served by Serve are restarted if the intervals have changed.
+func (updater *Updater) Reload(
+	groups []Group,
+	updateInterval int,
+	demandLimit int,
+	demandIdle int,
+) error {
+	schedules := updater.schedules()
+
+	err := updater.configure(groups, updateInterval, demandLimit, demandIdle)
+	if err != nil {
+		return err
+	}
+
+	updater.reschedule(schedules)
+
+	log.Infof(nil, "the updater configuration is reloaded")
+
+	return nil
+}
+
+// reschedule tells Serve to restart the schedules if they are not the given
+// ones anymore.
+func (updater *Updater) reschedule(schedules []time.Duration) {
+	if reflect.DeepEqual(schedules, updater.schedules()) {
+		return
+	}
+
+	select {
+	case updater.reloaded <- struct{}{}:
+	default:
+		// Serve is already going to restart the schedules
+	}
+}
+
+// configure validates the given groups and settings and applies them at
+// once, the pairs that are not refreshed anymore are forgotten.
+func (updater *Updater) configure(
+	groups []Group,
+	updateInterval int,
+	demandLimit int,
+	demandIdle int,
+) error {
+	if updateInterval <= 0 {
+		return fmt.Errorf(
+			"update interval should be positive, but got %d",
+			updateInterval,
+		)
+	}
+
+	if demandLimit < 0 || demandIdle < 0 {
+		return fmt.Errorf(
+			"demand limit and idle timeout should not be negative, "+
+				"but got %d and %d",
+			demandLimit,
+			demandIdle,
+		)
+	}
+
+	for _, group := range groups {
+		if group.Interval < 0 || group.TTL < 0 {
+			return fmt.Errorf(
+				"interval and ttl of group %q should not be negative, "+
+					"but got %d and %d",
+				group.Name,
+				group.Interval,
+				group.TTL,
+			)
+		}
+	}
+
+	defaultInterval := time.Duration(updateInterval) * time.Second
+
+	configured, intervals, ttls, names := tiers(groups, defaultInterval)
+
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+
+	updater.configured = configured
+	updater.intervals = intervals
+	updater.ttls = ttls
+	updater.groups = names
+	updater.updateInterval = defaultInterval
+	updater.demandLimit = demandLimit
+	updater.demandIdle = time.Duration(demandIdle) * time.Second
+
+	// the dropped pairs are deleted from the watchlist once it's loaded
+	updater.trimDemand()
+
+	for pair := range updater.states {
+		if !updater.tracks(pair) {
+			delete(updater.states, pair)
+		}
+	}
+
+	return nil
 }
 
 // Update is a core function of Updater and is invoked by Serve(). It updates
-// the prices in the cache storage.
-func (updater *Updater) Update() error {
+// the prices of all pairs in the cache storage. Cancelling the given context
+// cancels both the upstream requests and the cache writes.
+//
+// Every received pair is written, the returned error only summarizes the
+// pairs that failed, see Status() for details.
+func (updater *Updater) Update(ctx context.Context) error {
+	updater.syncDemand(ctx)
+
+	updater.mutex.Lock()
+	pairs := updater.pairs()
+	updater.mutex.Unlock()
+
+	return updater.update(ctx, pairs)
+}
+
+// update updates the prices of the given pairs except the postponed ones.
+func (updater *Updater) update(
+	ctx context.Context,
+	pairs []cryptocompare.Pair,
+) error {
 	startedAt := time.Now()
 
+	pairs = updater.due(updater.owned(pairs), startedAt)
+	if len(pairs) == 0 {
+		log.Debugf(
+			nil,
+			"updater: no pairs to update, they are postponed due to "+
+				"failures or refreshed by other instances",
+		)
+
+		return nil
+	}
+
+	return updater.refresh(ctx, pairs, startedAt)
+}
+
+// refresh requests the prices of the given pairs in as few upstream calls as
+// possible and writes them into the cache storage.
+func (updater *Updater) refresh(
+	ctx context.Context,
+	pairs []cryptocompare.Pair,
+	startedAt time.Time,
+) error {
+	ctx = events.WithSource(ctx, events.SourceUpdater)
+
+	batches := cryptocompare.Plan(
+		pairs,
+		cryptocompare.MaxFsymsLength,
+		cryptocompare.MaxTsymsLength,
+	)
+
 	log.Debugf(
 		karma.
-			Describe("fsyms", strings.Join(updater.fsyms, ",")).
-			Describe("tsyms", strings.Join(updater.tsyms, ",")),
+			Describe("pairs", len(pairs)).
+			Describe("batches", len(batches)),
 		"updater: updating the price list",
 	)
 
-	list, err := updater.client.GetPriceList(updater.fsyms, updater.tsyms)
-	if err != nil {
+	list, err := cryptocompare.GetBatches(
+		ctx,
+		updater.client,
+		batches,
+		updater.concurrency,
+	)
+	if err != nil && list == nil {
+		// neither cancellation nor the exhausted budget are the fault of the
+		// pairs, so they are not postponed
+		if ctx.Err() == nil &&
+			!karma.Contains(err, cryptocompare.ErrBudgetExhausted) {
+			for _, pair := range pairs {
+				updater.fail(pair, startedAt, err)
+			}
+		}
+
 		return karma.Format(err, "get price list")
 	}
 
-	// first we need to check if the price list has everything is according to
-	// what we have asked for.
-	for _, fsym := range updater.fsyms {
-		if _, ok := list.Raw[fsym]; !ok {
-			return fmt.Errorf(
-				"the received price list (raw) doesn't have %q",
-				fsym,
-			)
-		}
-
-		if _, ok := list.Display[fsym]; !ok {
-			return fmt.Errorf(
-				"the received price list (display) doesn't have %q",
-				fsym,
-			)
+	reasons := map[cryptocompare.Pair]error{}
+	if partial, ok := err.(*cryptocompare.PartialError); ok {
+		for _, chunk := range partial.Chunks {
+			for _, fsym := range chunk.Fsyms {
+				for _, tsym := range chunk.Tsyms {
+					pair := cryptocompare.Pair{Fsym: fsym, Tsym: tsym}
+					reasons[pair] = chunk.Err
+				}
+			}
 		}
+	}
 
-		for _, tsym := range updater.tsyms {
-			if _, ok := list.Raw[fsym][tsym]; !ok {
-				return fmt.Errorf(
-					"the received price list of %s (raw) doesn't have %q",
-					fsym,
-					tsym,
+	failures := 0
+	for _, pair := range pairs {
+		raw, hasRaw := list.Raw[pair.Fsym][pair.Tsym]
+		display, hasDisplay := list.Display[pair.Fsym][pair.Tsym]
+		if !hasRaw || !hasDisplay {
+			reason, ok := reasons[pair]
+			if !ok {
+				reason = fmt.Errorf(
+					"the received price list doesn't have %s",
+					pair,
 				)
 			}
 
-			if _, ok := list.Display[fsym][tsym]; !ok {
-				return fmt.Errorf(
-					"the received price list of %s (display) doesn't have %q",
-					fsym,
-					tsym,
-				)
+			updater.fail(pair, startedAt, reason)
+			failures++
+
+			continue
+		}
+
+		err := updater.cache.Write(
+			ctx,
+			startedAt,
+			pair.Fsym,
+			pair.Tsym,
+			raw,
+			display,
+		)
+		if err != nil {
+			if ctx.Err() != nil {
+				return karma.Format(err, "cache write of %s", pair)
 			}
+
+			updater.fail(pair, startedAt, karma.Format(err, "cache write"))
+			failures++
+
+			continue
 		}
+
+		updater.succeed(pair, startedAt)
 	}
 
-	for _, fsym := range updater.fsyms {
-		for _, tsym := range updater.tsyms {
-			err := updater.cache.Write(
-				context.Background(),
-				startedAt,
-				fsym,
-				tsym,
-				list.Raw[fsym][tsym],
-				list.Display[fsym][tsym],
-			)
-			if err != nil {
-				return karma.Format(err, "cache write of %s to %s", fsym, tsym)
+	if failures > 0 {
+		return fmt.Errorf(
+			"unable to update %d of %d pairs",
+			failures,
+			len(pairs),
+		)
+	}
+
+	return nil
+}
+
+// Tracks returns true if the updater refreshes the given pair.
+func (updater *Updater) Tracks(pair cryptocompare.Pair) bool {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+
+	return updater.tracks(pair)
+}
+
+// tracks is Tracks expected to be called with the mutex locked.
+func (updater *Updater) tracks(pair cryptocompare.Pair) bool {
+	_, configured := updater.intervals[pair]
+	_, demanded := updater.demand[pair]
+
+	return configured || demanded || updater.admin[pair]
+}
+
+// TTLs returns the TTLs (seconds) of the pairs of the given groups having a
+// TTL of their own, the pair listed in several groups has the TTL of the
+// group it's refreshed with (see New).
+func TTLs(groups []Group, updateInterval int) map[cryptocompare.Pair]int {
+	_, _, ttls, _ := tiers(
+		groups,
+		time.Duration(updateInterval)*time.Second,
+	)
+
+	for pair, ttl := range ttls {
+		if ttl <= 0 {
+			delete(ttls, pair)
+		}
+	}
+
+	return ttls
+}
+
+// tiers returns the configured pairs in the configured order along with the
+// interval, the TTL and the name of the group every pair is refreshed with:
+// the one of the shortest interval.
+func tiers(groups []Group, defaultInterval time.Duration) (
+	configured []cryptocompare.Pair,
+	intervals map[cryptocompare.Pair]time.Duration,
+	ttls map[cryptocompare.Pair]int,
+	names map[cryptocompare.Pair]string,
+) {
+	configured = []cryptocompare.Pair{}
+	intervals = map[cryptocompare.Pair]time.Duration{}
+	ttls = map[cryptocompare.Pair]int{}
+	names = map[cryptocompare.Pair]string{}
+
+	for _, group := range groups {
+		interval := defaultInterval
+		if group.Interval > 0 {
+			interval = time.Duration(group.Interval) * time.Second
+		}
+
+		for _, pair := range group.Pairs {
+			known, ok := intervals[pair]
+			if !ok {
+				configured = append(configured, pair)
+			}
+
+			if !ok || interval < known {
+				intervals[pair] = interval
+				ttls[pair] = group.TTL
+				names[pair] = group.Name
 			}
 		}
 	}
 
-	return nil
+	return configured, intervals, ttls, names
 }
 
-// Serve is expected to be running in a goroutine. It waits for the specified
-// time and invokes the Update() method.
-func (updater *Updater) Serve() error {
+// pairs returns all pairs the updater refreshes, the configured ones go
+// first. It's expected to be called with the mutex locked.
+func (updater *Updater) pairs() []cryptocompare.Pair {
+	pairs := append([]cryptocompare.Pair{}, updater.configured...)
+	for pair := range updater.admin {
+		if _, ok := updater.intervals[pair]; !ok {
+			pairs = append(pairs, pair)
+		}
+	}
+
+	for pair := range updater.demand {
+		// the pair may have been configured since it's tracked
+		if _, ok := updater.intervals[pair]; !ok && !updater.admin[pair] {
+			pairs = append(pairs, pair)
+		}
+	}
+
+	return pairs
+}
+
+// interval returns the refresh interval of the given pair. It's expected to
+// be called with the mutex locked.
+func (updater *Updater) interval(pair cryptocompare.Pair) time.Duration {
+	if interval, ok := updater.intervals[pair]; ok {
+		return interval
+	}
+
+	return updater.updateInterval
+}
+
+// schedules returns the distinct refresh intervals in ascending order, every
+// interval is served independently.
+func (updater *Updater) schedules() []time.Duration {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+
+	seen := map[time.Duration]bool{}
+	if updater.demandLimit > 0 || len(updater.admin) > 0 || updater.shared {
+		seen[updater.updateInterval] = true
+	}
+
+	for _, interval := range updater.intervals {
+		seen[interval] = true
+	}
+
+	schedules := []time.Duration{}
+	for interval := range seen {
+		schedules = append(schedules, interval)
+	}
+
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i] < schedules[j]
+	})
+
+	return schedules
+}
+
+// refreshesDemand returns true if the pairs tracked due to demand are
+// refreshed with the given interval.
+//
+// The pairs added by admins are refreshed with the same interval, but there
+// is nothing to sync for them.
+func (updater *Updater) refreshesDemand(interval time.Duration) bool {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+
+	return updater.demandLimit > 0 && interval == updater.updateInterval
+}
+
+// scheduled returns the pairs refreshed with the given interval.
+func (updater *Updater) scheduled(
+	interval time.Duration,
+) []cryptocompare.Pair {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+
+	pairs := []cryptocompare.Pair{}
+	for _, pair := range updater.pairs() {
+		if updater.interval(pair) == interval {
+			pairs = append(pairs, pair)
+		}
+	}
+
+	return pairs
+}
+
+// due returns the given pairs that are not postponed due to recent
+// failures.
+func (updater *Updater) due(
+	pairs []cryptocompare.Pair,
+	now time.Time,
+) []cryptocompare.Pair {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+
+	result := []cryptocompare.Pair{}
+	for _, pair := range pairs {
+		if updater.state(pair).retryAt.After(now) {
+			continue
+		}
+
+		result = append(result, pair)
+	}
+
+	return result
+}
+
+func (updater *Updater) succeed(pair cryptocompare.Pair, at time.Time) {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+
+	updater.state(pair).succeed(at)
+}
+
+func (updater *Updater) fail(
+	pair cryptocompare.Pair,
+	at time.Time,
+	err error,
+) {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+
+	state := updater.state(pair)
+	state.fail(at, err, updater.interval(pair))
+
+	log.Warningf(
+		err,
+		"updater: unable to update %s, failed %d time(s), retry at %s",
+		pair,
+		state.failures,
+		state.retryAt.Format(time.RFC3339),
+	)
+}
+
+// Serve is expected to be running in a goroutine. Pairs sharing the same
+// interval are updated together, every interval is served independently by
+// waiting for the interval and invoking update() for its pairs. The pairs
+// tracked due to demand are updated with the updater's update interval.
+//
+// The intervals are randomized (see jitter), so the schedules don't line up
+// into bursts of upstream calls. The schedules are restarted once the
+// intervals are changed by Reload.
+//
+// Every update is bounded by its interval, there is no point in waiting for
+// an update longer than that since the next one is already due. Updates are
+// made with the background priority, so they are skipped rather than
+// spending the upstream budget reserved for on-demand requests.
+//
+// Failed updates are logged and never stop the updater.
+func (updater *Updater) Serve() {
 	log.Infof(nil, "the updater has started")
 
+	for {
+		stop := make(chan struct{})
+		workers := sync.WaitGroup{}
+		for _, interval := range updater.schedules() {
+			workers.Add(1)
+			go func(interval time.Duration) {
+				defer workers.Done()
+
+				updater.serve(interval, stop)
+			}(interval)
+		}
+
+		select {
+		case <-updater.reloaded:
+			// the updates in progress are completed before restarting
+			close(stop)
+			workers.Wait()
+
+			log.Infof(nil, "updater: the schedules are restarted")
+
+		case <-updater.context.Done():
+			close(stop)
+			workers.Wait()
+
+			return
+		}
+	}
+}
+
+// jitter returns the given interval randomized by up to jitterFactor in both
+// directions.
+func jitter(interval time.Duration) time.Duration {
+	spread := int64(float64(interval) * jitterFactor)
+	if spread <= 0 {
+		return interval
+	}
+
+	return interval + time.Duration(rand.Int63n(2*spread+1)-spread)
+}
+
+// serve updates the pairs of the given interval until stop is closed or the
+// updater is closed.
+func (updater *Updater) serve(interval time.Duration, stop chan struct{}) {
 	for {
 		select {
-		case <-time.After(time.Duration(updater.updateInterval) * time.Second):
+		case <-time.After(jitter(interval)):
 			//
-		case <-updater.done:
-			return nil
+		case <-stop:
+			return
+		case <-updater.context.Done():
+			return
 		}
 
-		err := updater.Update()
+		ctx, cancel := context.WithTimeout(updater.context, interval)
+		ctx = cryptocompare.WithBackgroundPriority(ctx)
+
+		if updater.syncsWatchlist(interval) {
+			updater.syncWatchlist(ctx)
+		}
+
+		// the pairs requested from followers are persisted, so the leader
+		// picks them up
+		if updater.refreshesDemand(interval) {
+			updater.syncDemand(ctx)
+		}
+
+		if updater.Paused() {
+			cancel()
+			continue
+		}
+
+		err := updater.update(ctx, updater.scheduled(interval))
+		cancel()
 		if err != nil {
-			return err
+			if updater.context.Err() != nil {
+				// the updater has been closed in the middle of the update
+				return
+			}
+
+			if karma.Contains(err, cryptocompare.ErrBudgetExhausted) {
+				log.Warningf(
+					err,
+					"updater: update of every %v skipped, budget is low",
+					interval,
+				)
+				continue
+			}
+
+			log.Errorf(err, "updater: update of every %v failed", interval)
 		}
 	}
 }
 
-// Close immediately stops the Updater instance.
+// Close immediately stops the Updater instance and cancels the update in
+// progress if any.
 func (updater *Updater) Close() {
-	close(updater.done)
+	updater.cancel()
 }
@@ -0,0 +1,489 @@
+package updater
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cache"
+	"github.com/kovetskiy/cryptocompare-proxyd/internal/cryptocompare"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClient returns prices of all requested pairs except the delisted ones.
+type fakeClient struct {
+	delisted map[string]bool
+	calls    int
+}
+
+func (client *fakeClient) GetPriceList(
+	ctx context.Context,
+	fsyms []string,
+	tsyms []string,
+) (*cryptocompare.PriceList, error) {
+	client.calls++
+
+	list := &cryptocompare.PriceList{
+		Raw:     map[string]map[string]cryptocompare.RawPrice{},
+		Display: map[string]map[string]cryptocompare.DisplayPrice{},
+	}
+
+	for _, fsym := range fsyms {
+		if client.delisted[fsym] {
+			continue
+		}
+
+		list.Raw[fsym] = map[string]cryptocompare.RawPrice{}
+		list.Display[fsym] = map[string]cryptocompare.DisplayPrice{}
+
+		for _, tsym := range tsyms {
+			list.Raw[fsym][tsym] = cryptocompare.RawPrice{Price: 1}
+			list.Display[fsym][tsym] = cryptocompare.DisplayPrice{Price: "1"}
+		}
+	}
+
+	return list, nil
+}
+
+func newTestCache(t *testing.T) cache.Cache {
+	storage, err := cache.New(cache.BackendMemory, "", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.Boot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage
+}
+
+func TestUpdater_Update_WritesReceivedPairs(t *testing.T) {
+	test := assert.New(t)
+
+	storage := newTestCache(t)
+
+	updater, err := New(
+		&fakeClient{delisted: map[string]bool{"DEAD": true}},
+		4,
+		storage,
+		[]Group{CrossGroup("", []string{"BTC", "DEAD"}, []string{"USD"})},
+		30,
+		0,
+		0,
+	)
+	test.NoError(err)
+
+	err = updater.Update(context.Background())
+	test.Error(err)
+
+	entities, err := storage.Read(
+		context.Background(),
+		[]string{"BTC", "DEAD"},
+		[]string{"USD"},
+		60,
+	)
+	test.NoError(err)
+
+	if test.Len(entities, 1) {
+		test.Equal("BTC", entities[0].FromSymbol())
+	}
+
+	statuses := updater.Status()
+	if test.Len(statuses, 2) {
+		test.Equal("BTC", statuses[0].Fsym)
+		test.NotNil(statuses[0].LastSuccess)
+		test.Equal(0, statuses[0].Failures)
+
+		test.Equal("DEAD", statuses[1].Fsym)
+		test.Nil(statuses[1].LastSuccess)
+		test.Equal(1, statuses[1].Failures)
+		test.NotEmpty(statuses[1].LastError)
+		test.NotNil(statuses[1].RetryAt)
+	}
+}
+
+func TestUpdater_Update_PostponesFailedPairs(t *testing.T) {
+	test := assert.New(t)
+
+	client := &fakeClient{delisted: map[string]bool{"DEAD": true}}
+
+	updater, err := New(
+		client,
+		4,
+		newTestCache(t),
+		[]Group{CrossGroup("", []string{"BTC", "DEAD"}, []string{"USD"})},
+		30,
+		0,
+		0,
+	)
+	test.NoError(err)
+
+	test.Error(updater.Update(context.Background()))
+
+	// the failed pair is postponed, so the second update has nothing to
+	// complain about
+	test.NoError(updater.Update(context.Background()))
+	test.Equal(1, updater.Status()[1].Failures)
+}
+
+func TestUpdater_Update_WritesGroupedPairsOnly(t *testing.T) {
+	test := assert.New(t)
+
+	client := &fakeClient{}
+	storage := newTestCache(t)
+
+	updater, err := New(
+		client,
+		4,
+		storage,
+		[]Group{
+			{
+				Name:     "hot",
+				Interval: 10,
+				TTL:      20,
+				Pairs: []cryptocompare.Pair{
+					{Fsym: "BTC", Tsym: "USD"},
+					{Fsym: "ETH", Tsym: "EUR"},
+				},
+			},
+			{
+				Pairs: []cryptocompare.Pair{
+					{Fsym: "DOGE", Tsym: "BTC"},
+					{Fsym: "BTC", Tsym: "USD"},
+				},
+			},
+		},
+		30,
+		0,
+		0,
+	)
+	test.NoError(err)
+
+	test.NoError(updater.Update(context.Background()))
+	test.Equal(1, client.calls)
+
+	entities, err := storage.Read(
+		context.Background(),
+		[]string{"BTC", "ETH", "DOGE"},
+		[]string{"USD", "EUR", "BTC"},
+		60,
+	)
+	test.NoError(err)
+	test.Len(entities, 3)
+
+	statuses := updater.Status()
+	if test.Len(statuses, 3) {
+		test.Equal("BTC", statuses[0].Fsym)
+		test.Equal("hot", statuses[0].Group)
+		test.Equal(10, statuses[0].Interval)
+
+		test.Equal("DOGE", statuses[1].Fsym)
+		test.Equal(30, statuses[1].Interval)
+	}
+
+	test.Len(updater.scheduled(10*time.Second), 2)
+	test.Len(updater.scheduled(30*time.Second), 1)
+
+	test.Equal(20, statuses[0].TTL)
+	test.Equal(0, statuses[1].TTL)
+}
+
+func TestTTLs_ReturnsTTLsOfGroupsPairsAreRefreshedWith(t *testing.T) {
+	test := assert.New(t)
+
+	btc := cryptocompare.Pair{Fsym: "BTC", Tsym: "USD"}
+	eth := cryptocompare.Pair{Fsym: "ETH", Tsym: "USD"}
+	doge := cryptocompare.Pair{Fsym: "DOGE", Tsym: "USD"}
+
+	ttls := TTLs(
+		[]Group{
+			{TTL: 600, Pairs: []cryptocompare.Pair{btc, eth}},
+			{Interval: 10, TTL: 20, Pairs: []cryptocompare.Pair{btc}},
+			{Interval: 60, TTL: 120, Pairs: []cryptocompare.Pair{eth}},
+			{Pairs: []cryptocompare.Pair{doge}},
+		},
+		30,
+	)
+
+	test.Equal(map[cryptocompare.Pair]int{btc: 20, eth: 600}, ttls)
+}
+
+func TestJitter_RandomizesIntervalWithinBounds(t *testing.T) {
+	test := assert.New(t)
+
+	for i := 0; i < 100; i++ {
+		delay := jitter(10 * time.Second)
+		test.GreaterOrEqual(int64(delay), int64(9*time.Second))
+		test.LessOrEqual(int64(delay), int64(11*time.Second))
+	}
+}
+
+func TestUpdater_Track_RefreshesDemandedPairsUntilIdle(t *testing.T) {
+	test := assert.New(t)
+
+	storage := newTestCache(t)
+
+	updater, err := New(
+		&fakeClient{},
+		4,
+		storage,
+		[]Group{CrossGroup("", []string{"BTC"}, []string{"USD"})},
+		30,
+		10,
+		3600,
+	)
+	test.NoError(err)
+
+	eth := cryptocompare.Pair{Fsym: "ETH", Tsym: "EUR"}
+
+	updater.Track([]cryptocompare.Pair{eth})
+	test.True(updater.Tracks(eth))
+
+	test.NoError(updater.Update(context.Background()))
+
+	entities, err := storage.Read(
+		context.Background(),
+		[]string{"ETH"},
+		[]string{"EUR"},
+		60,
+	)
+	test.NoError(err)
+	test.Len(entities, 1)
+
+	watches, err := storage.ReadWatchlist(context.Background())
+	test.NoError(err)
+	if test.Len(watches, 1) {
+		test.Equal("ETH", watches[0].FromSymbol())
+		test.Equal(SourceDemand, watches[0].Source())
+	}
+
+	// the tracked pairs survive restarts
+	restarted, err := New(
+		&fakeClient{},
+		4,
+		storage,
+		[]Group{CrossGroup("", []string{"BTC"}, []string{"USD"})},
+		30,
+		10,
+		3600,
+	)
+	test.NoError(err)
+	test.NoError(restarted.Load(context.Background()))
+	test.True(restarted.Tracks(eth))
+
+	// the pair is dropped once it's not requested for the idle timeout
+	restarted.demandIdle = 0
+	test.NoError(restarted.Update(context.Background()))
+	test.False(restarted.Tracks(eth))
+
+	watches, err = storage.ReadWatchlist(context.Background())
+	test.NoError(err)
+	test.Len(watches, 0)
+}
+
+func TestUpdater_syncDemand_KeepsPairsSeenByOtherInstances(t *testing.T) {
+	test := assert.New(t)
+
+	storage := newTestCache(t)
+
+	updater, err := New(&fakeClient{}, 4, storage, nil, 30, 10, 60)
+	test.NoError(err)
+
+	eth := cryptocompare.Pair{Fsym: "ETH", Tsym: "EUR"}
+
+	updater.Track([]cryptocompare.Pair{eth})
+	updater.demand[eth].seenAt = time.Now().Add(-time.Hour)
+
+	// another instance sharing the watchlist has seen the pair recently
+	test.NoError(storage.WriteWatch(
+		context.Background(),
+		time.Now(),
+		eth.Fsym,
+		eth.Tsym,
+		SourceDemand,
+	))
+
+	updater.syncDemand(context.Background())
+	test.False(updater.Tracks(eth))
+
+	watches, err := storage.ReadWatchlist(context.Background())
+	test.NoError(err)
+	test.Len(watches, 1)
+}
+
+func TestUpdater_Load_LimitsDemandedPairs(t *testing.T) {
+	test := assert.New(t)
+
+	storage := newTestCache(t)
+
+	now := time.Now()
+	for i, fsym := range []string{"BTC", "ETH", "XRP"} {
+		err := storage.WriteWatch(
+			context.Background(),
+			now.Add(time.Duration(i)*time.Minute),
+			fsym,
+			"USD",
+			SourceDemand,
+		)
+		test.NoError(err)
+	}
+
+	// the limit is reduced since the pairs were tracked
+	updater, err := New(
+		&fakeClient{},
+		4,
+		storage,
+		nil,
+		30,
+		2,
+		3600,
+	)
+	test.NoError(err)
+	test.NoError(updater.Load(context.Background()))
+
+	// the least recently requested pair is dropped
+	test.False(updater.Tracks(cryptocompare.Pair{Fsym: "BTC", Tsym: "USD"}))
+	test.True(updater.Tracks(cryptocompare.Pair{Fsym: "ETH", Tsym: "USD"}))
+	test.True(updater.Tracks(cryptocompare.Pair{Fsym: "XRP", Tsym: "USD"}))
+
+	watches, err := storage.ReadWatchlist(context.Background())
+	test.NoError(err)
+	test.Len(watches, 2)
+
+	test.NoError(updater.Reload(nil, 30, 1, 3600))
+	test.False(updater.Tracks(cryptocompare.Pair{Fsym: "ETH", Tsym: "USD"}))
+	test.True(updater.Tracks(cryptocompare.Pair{Fsym: "XRP", Tsym: "USD"}))
+}
+
+func TestUpdater_Reload_AppliesValidConfigurationOnly(t *testing.T) {
+	test := assert.New(t)
+
+	updater, err := New(
+		&fakeClient{},
+		4,
+		newTestCache(t),
+		[]Group{CrossGroup("", []string{"BTC"}, []string{"USD"})},
+		30,
+		0,
+		0,
+	)
+	test.NoError(err)
+
+	btc := cryptocompare.Pair{Fsym: "BTC", Tsym: "USD"}
+	eth := cryptocompare.Pair{Fsym: "ETH", Tsym: "USD"}
+
+	err = updater.Reload(
+		[]Group{{Interval: 10, Pairs: []cryptocompare.Pair{eth}}},
+		30,
+		0,
+		0,
+	)
+	test.NoError(err)
+	test.False(updater.Tracks(btc))
+	test.True(updater.Tracks(eth))
+	test.Equal([]time.Duration{10 * time.Second}, updater.schedules())
+
+	// Serve is told to restart the schedules
+	test.Len(updater.reloaded, 1)
+
+	err = updater.Reload(
+		[]Group{{Interval: -1, Pairs: []cryptocompare.Pair{btc}}},
+		30,
+		0,
+		0,
+	)
+	test.Error(err)
+	test.False(updater.Tracks(btc))
+	test.True(updater.Tracks(eth))
+}
+
+func TestUpdater_Pause_SyncsWatchlistSharedWithFollowers(t *testing.T) {
+	test := assert.New(t)
+
+	storage := newTestCache(t)
+
+	newUpdater := func() *Updater {
+		updater, err := New(
+			&fakeClient{},
+			4,
+			storage,
+			[]Group{CrossGroup("", []string{"BTC"}, []string{"USD"})},
+			30,
+			10,
+			3600,
+		)
+		test.NoError(err)
+
+		return updater
+	}
+
+	leader := newUpdater()
+	follower := newUpdater()
+
+	leader.Pause()
+	follower.Pause()
+	leader.Resume()
+
+	test.False(leader.Paused())
+	test.True(follower.Paused())
+	test.True(leader.syncsWatchlist(30 * time.Second))
+	test.False(follower.syncsWatchlist(30 * time.Second))
+
+	eth := cryptocompare.Pair{Fsym: "ETH", Tsym: "EUR"}
+	doge := cryptocompare.Pair{Fsym: "DOGE", Tsym: "USD"}
+
+	// the pairs requested from the follower and added on it by admins are
+	// refreshed by the leader
+	follower.Track([]cryptocompare.Pair{eth})
+	follower.syncDemand(context.Background())
+	test.NoError(follower.Add(context.Background(), []cryptocompare.Pair{doge}))
+
+	leader.syncWatchlist(context.Background())
+	test.True(leader.Tracks(eth))
+	test.True(leader.Tracks(doge))
+
+	test.NoError(follower.Remove(context.Background(), []cryptocompare.Pair{doge}))
+
+	leader.syncWatchlist(context.Background())
+	test.False(leader.Tracks(doge))
+}
+
+func TestUpdater_Shard_UpdatesOwnedPairsOnly(t *testing.T) {
+	test := assert.New(t)
+
+	storage := newTestCache(t)
+
+	updater, err := New(
+		&fakeClient{},
+		4,
+		storage,
+		[]Group{CrossGroup("", []string{"BTC", "ETH"}, []string{"USD"})},
+		30,
+		0,
+		0,
+	)
+	test.NoError(err)
+
+	updater.Shard(func(pair cryptocompare.Pair) bool {
+		return pair.Fsym == "BTC"
+	})
+
+	test.NoError(updater.Update(context.Background()))
+
+	entities, err := storage.Read(
+		context.Background(),
+		[]string{"BTC", "ETH"},
+		[]string{"USD"},
+		60,
+	)
+	test.NoError(err)
+	if test.Len(entities, 1) {
+		test.Equal("BTC", entities[0].FromSymbol())
+	}
+
+	// the pairs of other instances are tracked anyway, so the server
+	// doesn't revalidate them
+	test.True(updater.Tracks(cryptocompare.Pair{Fsym: "ETH", Tsym: "USD"}))
+}